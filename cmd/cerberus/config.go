@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/sjtug/cerberus/directives"
+)
+
+// config is the configuration of the standalone proxy. It's written in Caddyfile syntax, e.g.:
+//
+//	listen :8080
+//	upstream http://127.0.0.1:8081
+//	base_url /.cerberus
+//	cerberus {
+//		difficulty 14
+//	}
+//
+// The cerberus block takes the same options as the cerberus global option of the Caddyfile.
+type config struct {
+	// Listen is the address to serve HTTP on.
+	Listen string
+	// Upstream is the URL of the server to proxy requests to.
+	Upstream *url.URL
+	// BaseURL is the path that challenge endpoints and static files are served under.
+	BaseURL string
+	// BlockOnly disables challenges. Known bad IPs are still blocked.
+	BlockOnly bool
+	// Observe lets every request through, and only records what would have happened to it.
+	Observe bool
+	// TrustedProxies are the proxies in front of cerberus whose X-Forwarded-For header is trusted.
+	TrustedProxies []netip.Prefix
+	// MetricsListen is the address to serve Prometheus metrics on. Disabled if empty.
+	MetricsListen string
+	// App is the global cerberus configuration.
+	App directives.App
+}
+
+func loadConfig(path string) (*config, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := caddyfile.Tokenize(body, path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{
+		Listen:  ":8080",
+		BaseURL: "/.cerberus",
+	}
+	if err := cfg.unmarshal(caddyfile.NewDispenser(tokens)); err != nil {
+		return nil, err
+	}
+
+	if cfg.Upstream == nil {
+		return nil, fmt.Errorf("%s: upstream is required", path)
+	}
+	// The base URL is registered as a pattern of http.ServeMux, which reads anything else as a host or wildcard.
+	if !strings.HasPrefix(cfg.BaseURL, "/") || strings.Trim(cfg.BaseURL, "/") == "" || strings.ContainsAny(cfg.BaseURL, " {}?#") {
+		return nil, fmt.Errorf("%s: base_url must be a path below /, e.g. /.cerberus", path)
+	}
+
+	return cfg, nil
+}
+
+func (c *config) unmarshal(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		switch d.Val() {
+		case "listen":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Listen = d.Val()
+		case "upstream":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			upstream, err := url.Parse(d.Val())
+			if err != nil || upstream.Scheme == "" || upstream.Host == "" {
+				return d.Errf("upstream must be an absolute URL")
+			}
+			c.Upstream = upstream
+		case "base_url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.BaseURL = d.Val()
+		case "block_only":
+			if !d.NextArg() {
+				c.BlockOnly = true
+				continue
+			}
+			blockOnly, ok := d.ScalarVal().(bool)
+			if !ok {
+				return d.Errf("block_only must be a boolean")
+			}
+			c.BlockOnly = blockOnly
+		case "observe":
+			if !d.NextArg() {
+				c.Observe = true
+				continue
+			}
+			observe, ok := d.ScalarVal().(bool)
+			if !ok {
+				return d.Errf("observe must be a boolean")
+			}
+			c.Observe = observe
+		case "trusted_proxies":
+			for d.NextArg() {
+				prefix, err := netip.ParsePrefix(d.Val())
+				if err != nil {
+					addr, err := netip.ParseAddr(d.Val())
+					if err != nil {
+						return d.Errf("trusted_proxies must be IP addresses or CIDR ranges: %v", err)
+					}
+					prefix = netip.PrefixFrom(addr, addr.BitLen())
+				}
+				c.TrustedProxies = append(c.TrustedProxies, prefix)
+			}
+		case "metrics_listen":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.MetricsListen = d.Val()
+		case "cerberus":
+			if err := c.App.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+				return err
+			}
+			continue
+		default:
+			return d.Errf("unknown directive '%s'", d.Val())
+		}
+
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "cerberus.conf")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, "upstream http://127.0.0.1:8081\n"))
+	if err != nil {
+		t.Fatalf("failed to load minimal config: %v", err)
+	}
+	if cfg.Listen != ":8080" || cfg.BaseURL != "/.cerberus" || cfg.Upstream.String() != "http://127.0.0.1:8081" {
+		t.Errorf("unexpected minimal config: %+v", cfg)
+	}
+	if cfg.BlockOnly || cfg.Observe || len(cfg.TrustedProxies) != 0 || cfg.MetricsListen != "" {
+		t.Errorf("expected options to be off by default, got %+v", cfg)
+	}
+
+	cfg, err = loadConfig(writeConfig(t, `
+listen :9000
+upstream https://backend.internal
+base_url /.challenge
+trusted_proxies 127.0.0.1 10.0.0.0/8
+block_only false
+observe
+metrics_listen 127.0.0.1:9090
+
+cerberus {
+	difficulty 6
+	max_pending 64
+}
+`))
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if cfg.Listen != ":9000" || cfg.BaseURL != "/.challenge" || cfg.Upstream.Host != "backend.internal" || cfg.MetricsListen != "127.0.0.1:9090" {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	if cfg.BlockOnly || !cfg.Observe {
+		t.Errorf("expected block_only to be off and observe on, got %v and %v", cfg.BlockOnly, cfg.Observe)
+	}
+	expectedProxies := []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32"), netip.MustParsePrefix("10.0.0.0/8")}
+	if !slices.Equal(cfg.TrustedProxies, expectedProxies) {
+		t.Errorf("expected trusted proxies %v, got %v", expectedProxies, cfg.TrustedProxies)
+	}
+	if cfg.App.Difficulty != 6 || cfg.App.MaxPending != 64 {
+		t.Errorf("expected the cerberus block to be parsed, got %+v", cfg.App.Config)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "missing upstream", body: "listen :8080\n"},
+		{name: "relative upstream", body: "upstream 127.0.0.1:8081\n"},
+		{name: "unknown directive", body: "upstream http://127.0.0.1:8081\nlisten_tls :443\n"},
+		{name: "extra argument", body: "upstream http://127.0.0.1:8081\nlisten :8080 :8081\n"},
+		{name: "missing argument", body: "upstream http://127.0.0.1:8081\nbase_url\n"},
+		{name: "invalid boolean", body: "upstream http://127.0.0.1:8081\nobserve maybe\n"},
+		{name: "invalid trusted proxy", body: "upstream http://127.0.0.1:8081\ntrusted_proxies localhost\n"},
+		{name: "root base URL", body: "upstream http://127.0.0.1:8081\nbase_url /\n"},
+		{name: "relative base URL", body: "upstream http://127.0.0.1:8081\nbase_url .cerberus\n"},
+		{name: "base URL with wildcard", body: "upstream http://127.0.0.1:8081\nbase_url /{path}\n"},
+		{name: "unknown cerberus option", body: "upstream http://127.0.0.1:8081\ncerberus {\n\tdifficullty 4\n}\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadConfig(writeConfig(t, tt.body)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.conf")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
@@ -0,0 +1,107 @@
+// Command cerberus runs cerberus as a standalone reverse proxy, for sites that aren't served by Caddy.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/handler"
+	"go.uber.org/zap"
+)
+
+func main() {
+	configPath := flag.String("config", "cerberus.conf", "path to the config file")
+	debug := flag.Bool("debug", false, "enable debug logging")
+	flag.Parse()
+
+	logger, err := newLogger(*debug)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create logger: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := run(*configPath, logger); err != nil {
+		logger.Fatal("cerberus exited", zap.Error(err))
+	}
+}
+
+func newLogger(debug bool) (*zap.Logger, error) {
+	if debug {
+		return zap.NewDevelopment()
+	}
+	return zap.NewProduction()
+}
+
+func run(configPath string, logger *zap.Logger) error {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	if err := cfg.App.Config.Provision(logger); err != nil {
+		return err
+	}
+	if err := cfg.App.Validate(); err != nil {
+		return err
+	}
+
+	instance, err := core.GetInstance(cfg.App.Config, logger)
+	if err != nil {
+		return err
+	}
+
+	if cfg.MetricsListen != "" {
+		registry := prometheus.NewRegistry()
+		if err := core.RegisterMetrics(registry); err != nil {
+			return err
+		}
+		metricsServer := &http.Server{
+			Addr:              cfg.MetricsListen,
+			Handler:           promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			logger.Info("serving metrics", zap.String("address", cfg.MetricsListen))
+			err := metricsServer.ListenAndServe()
+			logger.Error("metrics server stopped", zap.Error(err))
+		}()
+	}
+
+	baseURL := strings.TrimSuffix(cfg.BaseURL, "/")
+	clientIP := handler.ForwardedClientIP(cfg.TrustedProxies)
+
+	endpoint := handler.NewEndpoint(instance)
+	endpoint.ClientIP = clientIP
+	endpoint.Logger = logger.Named("endpoint")
+
+	middleware := handler.NewMiddleware(instance, baseURL)
+	middleware.BlockOnly = cfg.BlockOnly
+	middleware.Observe = cfg.Observe
+	middleware.ClientIP = clientIP
+	middleware.Logger = logger.Named("middleware")
+
+	mux := http.NewServeMux()
+	mux.Handle(baseURL+"/", http.StripPrefix(baseURL, endpoint))
+	mux.Handle("/", middleware.Wrap(httputil.NewSingleHostReverseProxy(cfg.Upstream)))
+
+	server := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	logger.Info("serving cerberus", zap.String("address", cfg.Listen), zap.Stringer("upstream", cfg.Upstream))
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
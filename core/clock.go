@@ -0,0 +1,17 @@
+package core
+
+import "time"
+
+// Clock tells the current time. It can be replaced to test time-dependent behaviour deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the clock used unless another one is configured.
+var SystemClock Clock = systemClock{}
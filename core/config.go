@@ -6,10 +6,16 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math/bits"
+	"net/http"
 	"os"
+	"path"
+	"slices"
 	"time"
 
+	"github.com/sjtug/cerberus/internal/botscore"
 	"github.com/sjtug/cerberus/internal/ipblock"
+	"github.com/zeebo/xxh3"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/ssh"
 )
@@ -18,29 +24,107 @@ const (
 	DefaultCookieName        = "cerberus-auth"
 	DefaultHeaderName        = "X-Cerberus-Status"
 	DefaultDifficulty        = 4
+	MaxDifficultyBits        = 64
+	DefaultChallengeStatus   = http.StatusOK
+	DefaultPuzzles           = 1
+	MaxPuzzles               = 64
+	DefaultChallengeTTL      = 5 * time.Minute
+	DefaultClockSkew         = 30 * time.Second
 	DefaultMaxPending        = 128
 	DefaultAccessPerApproval = 8
 	DefaultBlockTTL          = time.Hour * 24 // 1 day
 	DefaultPendingTTL        = time.Hour      // 1 hour
 	DefaultApprovalTTL       = time.Hour      // 1 hour
 	DefaultMaxMemUsage       = 1 << 29        // 512MB
+	DefaultDownloadTTL       = 10 * time.Minute
+	DefaultDownloadUses      = 4
 	DefaultTitle             = "Cerberus Challenge"
 	DefaultDescription       = "Making sure you're not a bot!"
 	DefaultIPV4Prefix        = 32
 	DefaultIPV6Prefix        = 64
 )
 
+const (
+	// RolloutByIPBlock assigns clients to the rollout cohort by the hash of their IP block.
+	RolloutByIPBlock = "ip_block"
+	// RolloutByCookie assigns clients to the rollout cohort by the hash of a signed random cookie set on their first
+	// request. Clients without a valid cookie are in the cohort.
+	RolloutByCookie = "cookie"
+)
+
+// RolloutConfig limits challenges to a cohort of clients, so that enforcement can be ramped up gradually.
+type RolloutConfig struct {
+	// Percent is the percentage of clients in the cohort, from 0 to 100.
+	// Clients stay in the cohort as it grows, so that raising it only adds clients.
+	Percent float64 `json:"percent"`
+	// By is how clients are assigned to the cohort, either "ip_block" or "cookie". Defaults to "ip_block".
+	By string `json:"by,omitempty"`
+}
+
 type Config struct {
-	// Challenge difficulty (number of leading zeroes in the hash).
+	// Challenge difficulty in units of two leading zero bits in the hash.
+	// Kept for compatibility. Must equal DifficultyBits/2 if both are set.
 	Difficulty int `json:"difficulty,omitempty"`
+	// DifficultyBits is the challenge difficulty as the number of leading zero bits in the hash.
+	// Each additional bit doubles the expected solve time. Defaults to twice Difficulty.
+	DifficultyBits int `json:"difficulty_bits,omitempty"`
+	// Puzzles is the number of independent sub-puzzles in each challenge. It must be a power of two.
+	// The difficulty of each sub-puzzle is lowered so that the total expected work stays the same, while the variance of solve time drops.
+	Puzzles int `json:"puzzles,omitempty"`
+	// ChallengeStatus is the HTTP status code of challenge pages, e.g. 401, 403, 429 or 503 to keep search engines
+	// from indexing them in place of the content. 429 and 503 responses carry a Retry-After header. Defaults to 200.
+	ChallengeStatus int `json:"challenge_status,omitempty"`
+	// ChallengeTTL is how long a challenge stays valid after it's issued.
+	// Wait tickets and image CAPTCHAs are valid for the same time after they become redeemable.
+	ChallengeTTL time.Duration `json:"challenge_ttl,omitempty"`
+	// ClockSkew is the tolerated clock difference between the nodes that issue and verify challenges.
+	ClockSkew time.Duration `json:"clock_skew,omitempty"`
+	// MaxHashRate is the maximum plausible hash rate (hashes per second) of a single solver thread.
+	// Answers solved faster than the iteration count of the solution allows are rejected and counted as pending requests.
+	// Zero disables the check.
+	MaxHashRate int64 `json:"max_hash_rate,omitempty"`
+	// WaitDelay is the delay after which a no-JavaScript wait ticket becomes redeemable.
+	// Users without JavaScript can pass the challenge by waiting this long instead. Zero disables the fallback.
+	WaitDelay time.Duration `json:"wait_delay,omitempty"`
+	// Captcha enables an image CAPTCHA fallback for users whose browser can't run WebAssembly.
+	Captcha bool `json:"captcha,omitempty"`
+	// ReplayBodyLimit is the maximum body size of a non-GET request that is stashed across a challenge and
+	// re-submitted after passing. Larger requests and requests from other origins are not preserved. Zero disables stashing.
+	ReplayBodyLimit int64 `json:"replay_body_limit,omitempty"`
+	// DownloadPatterns are glob patterns (as in path.Match) of the file names that get signed download links.
+	// After passing a challenge on a matching URL, the client is redirected to the URL with an expiring signature,
+	// which is accepted without the cookie, e.g. when the link is copied to a download manager.
+	DownloadPatterns []string `json:"download_patterns,omitempty"`
+	// DownloadTTL is how long a signed download link stays valid. It can't exceed ApprovalTTL.
+	DownloadTTL time.Duration `json:"download_ttl,omitempty"`
+	// DownloadUses is the number of requests allowed per signed download link.
+	DownloadUses int32 `json:"download_uses,omitempty"`
+	// BlockedFingerprints are TLS fingerprints (JA4, or JA3 hashes) of clients whose requests are always blocked.
+	// TLS fingerprints are only known for connections accepted through the cerberus_tls_fingerprint listener wrapper.
+	BlockedFingerprints []string `json:"blocked_fingerprints,omitempty"`
+	// FingerprintDifficultyBits overrides DifficultyBits for clients with the given TLS fingerprints (JA4, or JA3 hashes).
+	FingerprintDifficultyBits map[string]int `json:"fingerprint_difficulty_bits,omitempty"`
+	// BindFingerprint binds challenges, and so the cookies issued for them, to the JA4 fingerprint of the client,
+	// so that they can't be replayed from a different TLS stack.
+	BindFingerprint bool `json:"bind_fingerprint,omitempty"`
+	// BotScore scores requests by the consistency of their properties, e.g. a User-Agent claiming Chrome without the
+	// headers that Chrome sends, and maps the score to allowing, challenging or blocking them.
+	BotScore botscore.Config `json:"bot_score,omitempty"`
+	// Rollout only challenges a deterministic fraction of clients. The others pass as if cerberus wasn't there, except
+	// for the blocklist. Without it, every client is challenged.
+	Rollout *RolloutConfig `json:"rollout,omitempty"`
 	// When set to true, the handler will drop the connection instead of returning a 403 if the IP is blocked.
 	Drop bool `json:"drop,omitempty"`
 	// Ed25519 signing key file path. If not provided, a new key will be generated.
 	Ed25519KeyFile string `json:"ed25519_key_file,omitempty"`
 	// Ed25519 signing key content. If not provided, a new key will be generated.
 	Ed25519Key string `json:"ed25519_key,omitempty"`
+	// SiteverifySecret enables the form protection widget. Backends must send it as "secret" to validate widget tokens,
+	// so that nobody else holding a token can use it up before the backend does.
+	SiteverifySecret string `json:"siteverify_secret,omitempty"`
 	// MaxPending is the maximum number of pending (and failed) requests.
 	// Any IP block (prefix configured in prefix_cfg) with more than this number of pending requests will be blocked.
+	// Compact challenge responses to non-navigation requests are only counted for clients without an approval cookie.
 	MaxPending int32 `json:"max_pending,omitempty"`
 	// AccessPerApproval is the number of requests allowed per successful challenge.
 	AccessPerApproval int32 `json:"access_per_approval,omitempty"`
@@ -50,11 +134,15 @@ type Config struct {
 	PendingTTL time.Duration `json:"pending_ttl,omitempty"`
 	// ApprovalTTL is the time to live for approved requests.
 	ApprovalTTL time.Duration `json:"approval_ttl,omitempty"`
-	// MaxMemUsage is the maximum memory usage for the pending and blocklist caches.
+	// MaxMemUsage is the maximum memory usage for the pending, blocklist and approval caches and the used nonce filter.
+	// The used nonce filter takes 1/32 of it. It keeps the false positive rate (fresh challenges rejected as
+	// "nonce already used") below 0.1% for up to one challenge answer per 115 bytes within twice ChallengeTTL,
+	// e.g. 4.6 million answers every 10 minutes with the default 512MB.
+	// In observe mode, the shadow pending and blocklist caches take another 1/5 of it on top.
 	MaxMemUsage int64 `json:"max_mem_usage,omitempty"`
 	// CookieName is the name of the cookie used to store signed certificate.
 	CookieName string `json:"cookie_name,omitempty"`
-	// HeaderName is the name of the header used to store cerberus status ("PASS", "CHALLENGE", "FAIL", "BLOCKED", "DISABLED").
+	// HeaderName is the name of the header used to store cerberus status ("PASS", "CHALLENGE", "FAIL", "BLOCKED", "DISABLED", "PREFLIGHT", "OBSERVE", "ROLLOUT").
 	HeaderName string `json:"header_name,omitempty"`
 	// Title is the title of the challenge page.
 	Title string `json:"title,omitempty"`
@@ -63,13 +151,31 @@ type Config struct {
 	// PrefixCfg is to configure prefixes used to block users in these IP prefix blocks, e.g., /24 /64.
 	PrefixCfg ipblock.Config `json:"prefix_cfg,omitempty"`
 
+	// Clock tells the current time. Defaults to SystemClock.
+	Clock Clock `json:"-"`
+
 	ed25519Key ed25519.PrivateKey
 	ed25519Pub ed25519.PublicKey
 }
 
 func (c *Config) Provision(logger *zap.Logger) error {
-	if c.Difficulty == 0 {
-		c.Difficulty = DefaultDifficulty
+	if c.DifficultyBits == 0 {
+		if c.Difficulty == 0 {
+			c.Difficulty = DefaultDifficulty
+		}
+		c.DifficultyBits = c.Difficulty * 2
+	}
+	if c.Puzzles == 0 {
+		c.Puzzles = DefaultPuzzles
+	}
+	if c.ChallengeStatus == 0 {
+		c.ChallengeStatus = DefaultChallengeStatus
+	}
+	if c.ChallengeTTL == 0 {
+		c.ChallengeTTL = DefaultChallengeTTL
+	}
+	if c.ClockSkew == 0 {
+		c.ClockSkew = DefaultClockSkew
 	}
 	if c.MaxPending == 0 {
 		c.MaxPending = DefaultMaxPending
@@ -86,6 +192,12 @@ func (c *Config) Provision(logger *zap.Logger) error {
 	if c.ApprovalTTL == time.Duration(0) {
 		c.ApprovalTTL = DefaultApprovalTTL
 	}
+	if c.DownloadTTL == 0 {
+		c.DownloadTTL = min(DefaultDownloadTTL, c.ApprovalTTL)
+	}
+	if c.DownloadUses == 0 {
+		c.DownloadUses = DefaultDownloadUses
+	}
 	if c.MaxMemUsage == 0 {
 		c.MaxMemUsage = DefaultMaxMemUsage
 	}
@@ -98,6 +210,12 @@ func (c *Config) Provision(logger *zap.Logger) error {
 	if c.Title == "" {
 		c.Title = DefaultTitle
 	}
+	if c.BotScore.HarderBits == 0 {
+		c.BotScore.HarderBits = botscore.DefaultHarderBits
+	}
+	if c.Rollout != nil && c.Rollout.By == "" {
+		c.Rollout.By = RolloutByIPBlock
+	}
 	if c.PrefixCfg.IsEmpty() {
 		c.PrefixCfg = ipblock.Config{
 			V4Prefix: DefaultIPV4Prefix,
@@ -138,8 +256,43 @@ func (c *Config) Provision(logger *zap.Logger) error {
 }
 
 func (c *Config) Validate() error {
-	if c.Difficulty < 1 {
-		return errors.New("difficulty must be at least 1")
+	if c.Difficulty < 0 {
+		return errors.New("difficulty must not be negative")
+	}
+	if c.Difficulty != 0 && c.DifficultyBits != c.Difficulty*2 {
+		return errors.New("difficulty and difficulty_bits cannot both be set")
+	}
+	if c.DifficultyBits < 1 || c.DifficultyBits > MaxDifficultyBits {
+		return fmt.Errorf("difficulty_bits must be between 1 and %d", MaxDifficultyBits)
+	}
+	if c.Puzzles < 1 || c.Puzzles > MaxPuzzles || c.Puzzles&(c.Puzzles-1) != 0 {
+		return fmt.Errorf("puzzles must be a power of two between 1 and %d", MaxPuzzles)
+	}
+	if c.PuzzleDifficultyBits() < 1 {
+		return errors.New("difficulty_bits is too low for the number of puzzles")
+	}
+	for fingerprint, difficultyBits := range c.FingerprintDifficultyBits {
+		if minBits := 1 - c.PuzzleBits(0); difficultyBits < minBits || difficultyBits > MaxDifficultyBits {
+			return fmt.Errorf("fingerprint_difficulty_bits of %s must be between %d and %d", fingerprint, minBits, MaxDifficultyBits)
+		}
+	}
+	if c.ChallengeStatus != http.StatusOK && (c.ChallengeStatus < 400 || c.ChallengeStatus > 599) {
+		return errors.New("challenge_status must be 200 or an error status")
+	}
+	if c.ChallengeTTL < 0 {
+		return errors.New("challenge_ttl must be a positive duration")
+	}
+	if c.ClockSkew < 0 {
+		return errors.New("clock_skew must be a positive duration")
+	}
+	if c.MaxHashRate < 0 {
+		return errors.New("max_hash_rate must not be negative")
+	}
+	if c.WaitDelay < 0 {
+		return errors.New("wait_delay must be a positive duration")
+	}
+	if c.ReplayBodyLimit < 0 {
+		return errors.New("replay_body_limit must not be negative")
 	}
 	if c.MaxPending < 1 {
 		return errors.New("max_pending must be at least 1")
@@ -156,12 +309,34 @@ func (c *Config) Validate() error {
 	if c.ApprovalTTL < 0 {
 		return errors.New("approval_ttl must be a positive duration")
 	}
+	for _, pattern := range c.DownloadPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid download pattern %q: %w", pattern, err)
+		}
+	}
+	if c.DownloadTTL < 0 || c.DownloadTTL > c.ApprovalTTL {
+		return errors.New("download_ttl must be a positive duration no longer than approval_ttl")
+	}
+	if c.DownloadUses < 1 {
+		return errors.New("download_uses must be at least 1")
+	}
 	if c.MaxMemUsage < 1 {
 		return errors.New("max_mem_usage must be at least 1")
 	}
 	if c.Ed25519KeyFile != "" && c.Ed25519Key != "" {
 		return errors.New("ed25519_key_file and ed25519_key cannot both be set")
 	}
+	if c.Rollout != nil {
+		if c.Rollout.Percent < 0 || c.Rollout.Percent > 100 {
+			return errors.New("rollout percent must be between 0 and 100")
+		}
+		if c.Rollout.By != RolloutByIPBlock && c.Rollout.By != RolloutByCookie {
+			return fmt.Errorf("rollout must be by %s or %s", RolloutByIPBlock, RolloutByCookie)
+		}
+	}
+	if err := botscore.ValidateConfig(c.BotScore); err != nil {
+		return fmt.Errorf("bot_score: %w", err)
+	}
 	if err := ipblock.ValidateConfig(c.PrefixCfg); err != nil {
 		return fmt.Errorf("prefix_cfg: %w", err)
 	}
@@ -175,9 +350,100 @@ func (c *Config) StateCompatible(other *Config) bool {
 		c.ApprovalTTL == other.ApprovalTTL &&
 		c.AccessPerApproval == other.AccessPerApproval &&
 		c.MaxMemUsage == other.MaxMemUsage &&
+		c.ChallengeTTL == other.ChallengeTTL &&
+		c.ClockSkew == other.ClockSkew &&
 		c.PrefixCfg == other.PrefixCfg
 }
 
+// Now returns the current time of the configured clock.
+func (c *Config) Now() time.Time {
+	if c.Clock == nil {
+		return SystemClock.Now()
+	}
+	return c.Clock.Now()
+}
+
+// InWindow reports whether the current time is within the lifetime starting at start, tolerating clock skew.
+func (c *Config) InWindow(start time.Time, lifetime time.Duration) bool {
+	now := c.Now()
+	return !now.Before(start.Add(-c.ClockSkew)) && !now.After(start.Add(lifetime+c.ClockSkew))
+}
+
+// UsedNonceTTL returns how long used nonces must be remembered, i.e. the length of the window in which a challenge
+// can be answered, or swapped for a new one after it expired.
+func (c *Config) UsedNonceTTL() time.Duration {
+	return 2*c.ChallengeTTL + 2*c.ClockSkew
+}
+
+// MinSolveTime returns the minimum plausible time to compute the given number of hashes sequentially.
+// It returns zero if the check is disabled.
+func (c *Config) MinSolveTime(iterations uint64) time.Duration {
+	if c.MaxHashRate == 0 {
+		return 0
+	}
+	return time.Duration(float64(iterations) / float64(c.MaxHashRate) * float64(time.Second))
+}
+
+// IsDownload reports whether the file name of urlPath matches one of DownloadPatterns.
+func (c *Config) IsDownload(urlPath string) bool {
+	name := path.Base(urlPath)
+	for _, pattern := range c.DownloadPatterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// InRollout reports whether the client with the given key, i.e. its IP block or the ID of its rollout cookie, is in the
+// rollout cohort.
+// Every client is in the cohort without Rollout.
+func (c *Config) InRollout(key string) bool {
+	if c.Rollout == nil {
+		return true
+	}
+	// Keys are hashed to one of a million buckets, and the cohort is the lowest ones.
+	bucket := xxh3.HashString(key) % 1_000_000
+	return float64(bucket) < c.Rollout.Percent*10_000
+}
+
+// PuzzleDifficultyBits returns the difficulty of each sub-puzzle in leading zero bits.
+// Solving all sub-puzzles takes the same expected work as a single puzzle of DifficultyBits.
+func (c *Config) PuzzleDifficultyBits() int {
+	return c.PuzzleBits(c.DifficultyBits)
+}
+
+// PuzzleBits returns the difficulty of each sub-puzzle for a challenge of the given total difficulty.
+func (c *Config) PuzzleBits(difficultyBits int) int {
+	return difficultyBits - bits.TrailingZeros(uint(c.Puzzles)) // #nosec G115 -- validated to be positive
+}
+
+// TotalBits returns the total difficulty of a challenge whose sub-puzzles have the given difficulty.
+func (c *Config) TotalBits(puzzleBits int) int {
+	return puzzleBits + bits.TrailingZeros(uint(c.Puzzles)) // #nosec G115 -- validated to be positive
+}
+
+// DifficultyBitsFor returns the challenge difficulty for a client with the given TLS fingerprints.
+// The first fingerprint with an override wins, and DifficultyBits applies if there's none.
+func (c *Config) DifficultyBitsFor(fingerprints ...string) int {
+	for _, fingerprint := range fingerprints {
+		if difficultyBits, ok := c.FingerprintDifficultyBits[fingerprint]; ok && fingerprint != "" {
+			return difficultyBits
+		}
+	}
+	return c.DifficultyBits
+}
+
+// FingerprintBlocked reports whether any of the given TLS fingerprints is in BlockedFingerprints.
+func (c *Config) FingerprintBlocked(fingerprints ...string) bool {
+	for _, fingerprint := range fingerprints {
+		if fingerprint != "" && slices.Contains(c.BlockedFingerprints, fingerprint) {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Config) GetPublicKey() ed25519.PublicKey {
 	return c.ed25519Pub
 }
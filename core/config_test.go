@@ -1,7 +1,11 @@
 package core
 
 import (
+	"fmt"
 	"testing"
+	"time"
+
+	"go.uber.org/zap"
 )
 
 func TestLoadEd25519Key(t *testing.T) {
@@ -39,3 +43,319 @@ cxmAhDCdkx6OZkjWVeVANO29PgdeUDmTSeyKB817nYHyAAAAAAECAwQF
 		}
 	})
 }
+
+func TestDifficultyBits(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		expected int
+		valid    bool
+	}{
+		{
+			name:     "default",
+			config:   Config{},
+			expected: DefaultDifficulty * 2,
+			valid:    true,
+		},
+		{
+			name:     "legacy difficulty",
+			config:   Config{Difficulty: 7},
+			expected: 14,
+			valid:    true,
+		},
+		{
+			name:     "difficulty bits",
+			config:   Config{DifficultyBits: 13},
+			expected: 13,
+			valid:    true,
+		},
+		{
+			name:     "beyond 32 bits",
+			config:   Config{DifficultyBits: 40},
+			expected: 40,
+			valid:    true,
+		},
+		{
+			name:     "conflicting settings",
+			config:   Config{Difficulty: 7, DifficultyBits: 13},
+			expected: 13,
+			valid:    false,
+		},
+		{
+			name:     "too large",
+			config:   Config{DifficultyBits: MaxDifficultyBits + 1},
+			expected: MaxDifficultyBits + 1,
+			valid:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config
+			if err := c.Provision(zap.NewNop()); err != nil {
+				t.Fatalf("failed to provision config: %v", err)
+			}
+			if c.DifficultyBits != tt.expected {
+				t.Errorf("expected difficulty_bits to be %d, got %d", tt.expected, c.DifficultyBits)
+			}
+			if err := c.Validate(); (err == nil) != tt.valid {
+				t.Errorf("expected valid to be %v, got error %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestPuzzles(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   Config
+		expected int
+		valid    bool
+	}{
+		{
+			name:     "single puzzle",
+			config:   Config{DifficultyBits: 20},
+			expected: 20,
+			valid:    true,
+		},
+		{
+			name:     "four puzzles",
+			config:   Config{DifficultyBits: 20, Puzzles: 4},
+			expected: 18,
+			valid:    true,
+		},
+		{
+			name:     "not a power of two",
+			config:   Config{DifficultyBits: 20, Puzzles: 3},
+			expected: 20,
+			valid:    false,
+		},
+		{
+			name:     "too many puzzles for difficulty",
+			config:   Config{DifficultyBits: 2, Puzzles: 4},
+			expected: 0,
+			valid:    false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.config
+			if err := c.Provision(zap.NewNop()); err != nil {
+				t.Fatalf("failed to provision config: %v", err)
+			}
+			if got := c.PuzzleDifficultyBits(); got != tt.expected {
+				t.Errorf("expected puzzle difficulty bits to be %d, got %d", tt.expected, got)
+			}
+			if got := c.TotalBits(c.PuzzleDifficultyBits()); got != c.DifficultyBits {
+				t.Errorf("expected total difficulty bits to be %d, got %d", c.DifficultyBits, got)
+			}
+			if err := c.Validate(); (err == nil) != tt.valid {
+				t.Errorf("expected valid to be %v, got error %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestMinSolveTime(t *testing.T) {
+	disabled := Config{}
+	if got := disabled.MinSolveTime(1 << 30); got != 0 {
+		t.Errorf("expected no minimum solve time when disabled, got %s", got)
+	}
+
+	c := Config{MaxHashRate: 1_000_000}
+	if got := c.MinSolveTime(2_500_000); got != 2500*time.Millisecond {
+		t.Errorf("expected minimum solve time to be 2.5s, got %s", got)
+	}
+}
+
+func TestChallengeStatus(t *testing.T) {
+	tests := []struct {
+		status   int
+		expected int
+		valid    bool
+	}{
+		{status: 0, expected: 200, valid: true},
+		{status: 403, expected: 403, valid: true},
+		{status: 503, expected: 503, valid: true},
+		{status: 302, expected: 302, valid: false},
+		{status: 600, expected: 600, valid: false},
+	}
+
+	for _, tt := range tests {
+		c := Config{ChallengeStatus: tt.status}
+		if err := c.Provision(zap.NewNop()); err != nil {
+			t.Fatalf("failed to provision config: %v", err)
+		}
+		if c.ChallengeStatus != tt.expected {
+			t.Errorf("expected challenge status to be %d, got %d", tt.expected, c.ChallengeStatus)
+		}
+		if err := c.Validate(); (err == nil) != tt.valid {
+			t.Errorf("status %d: expected valid to be %v, got error %v", tt.status, tt.valid, err)
+		}
+	}
+}
+
+func TestIsDownload(t *testing.T) {
+	c := Config{DownloadPatterns: []string{"*.iso", "*.tar.*"}}
+
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{path: "/ubuntu-releases/24.04/ubuntu-24.04-desktop-amd64.iso", expected: true},
+		{path: "/gnu/hello/hello-2.12.tar.gz", expected: true},
+		{path: "/ubuntu-releases/24.04/", expected: false},
+		{path: "/isos/index.html", expected: false},
+	}
+
+	for _, tt := range tests {
+		if got := c.IsDownload(tt.path); got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.path, tt.expected, got)
+		}
+	}
+
+	invalid := Config{DownloadPatterns: []string{"[a-"}}
+	if err := invalid.Provision(zap.NewNop()); err != nil {
+		t.Fatalf("failed to provision config: %v", err)
+	}
+	if err := invalid.Validate(); err == nil {
+		t.Error("expected invalid download pattern to be rejected")
+	}
+}
+
+func TestFingerprintRules(t *testing.T) {
+	const (
+		ja4 = "t13d1516h2_8daaf6152771_e5627efa2ab1"
+		ja3 = "cd08e31494f9531f560d64c695473da9"
+	)
+
+	c := Config{
+		Puzzles:                   4,
+		BlockedFingerprints:       []string{ja3},
+		FingerprintDifficultyBits: map[string]int{ja4: 24},
+	}
+	if err := c.Provision(zap.NewNop()); err != nil {
+		t.Fatalf("failed to provision config: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("expected config to be valid, got %v", err)
+	}
+
+	if got := c.DifficultyBitsFor(ja3, ja4); got != 24 {
+		t.Errorf("expected overridden difficulty to be 24, got %d", got)
+	}
+	if got := c.DifficultyBitsFor("", ""); got != c.DifficultyBits {
+		t.Errorf("expected default difficulty %d without fingerprints, got %d", c.DifficultyBits, got)
+	}
+	if !c.FingerprintBlocked(ja3, ja4) {
+		t.Error("expected JA3 fingerprint to be blocked")
+	}
+	if c.FingerprintBlocked("", "") {
+		t.Error("expected unknown fingerprints not to be blocked")
+	}
+
+	c.FingerprintDifficultyBits[ja4] = 2
+	if err := c.Validate(); err == nil {
+		t.Error("expected override below the number of puzzles to be rejected")
+	}
+}
+
+func TestRollout(t *testing.T) {
+	if !(&Config{}).InRollout("192.0.2.0/24") {
+		t.Error("expected every client to be in the cohort without rollout")
+	}
+
+	c := Config{Rollout: &RolloutConfig{Percent: 10}}
+	if err := c.Provision(zap.NewNop()); err != nil {
+		t.Fatalf("failed to provision config: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("expected config to be valid, got %v", err)
+	}
+	if c.Rollout.By != RolloutByIPBlock {
+		t.Errorf("expected rollout by %s by default, got %s", RolloutByIPBlock, c.Rollout.By)
+	}
+
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)
+	}
+	cohort := func() map[string]bool {
+		in := make(map[string]bool)
+		for _, key := range keys {
+			if c.InRollout(key) {
+				in[key] = true
+			}
+		}
+		return in
+	}
+
+	small := cohort()
+	if len(small) < 900 || len(small) > 1100 {
+		t.Errorf("expected about 10%% of clients in the cohort, got %d of %d", len(small), len(keys))
+	}
+
+	c.Rollout.Percent = 50
+	large := cohort()
+	for key := range small {
+		if !large[key] {
+			t.Errorf("expected %s to stay in the cohort as it grows", key)
+		}
+	}
+
+	c.Rollout.Percent = 0
+	if len(cohort()) != 0 {
+		t.Error("expected no client in an empty cohort")
+	}
+	c.Rollout.Percent = 100
+	if len(cohort()) != len(keys) {
+		t.Error("expected every client in a full cohort")
+	}
+
+	for _, invalid := range []RolloutConfig{{Percent: 101, By: RolloutByIPBlock}, {Percent: 10, By: "user_agent"}} {
+		c.Rollout = &invalid
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected rollout %+v to be rejected", invalid)
+		}
+	}
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func TestInWindow(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	clock := &fakeClock{}
+	c := Config{Clock: clock}
+	if err := c.Provision(zap.NewNop()); err != nil {
+		t.Fatalf("failed to provision config: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		expected bool
+	}{
+		{name: "at start", now: start, expected: true},
+		{name: "within lifetime", now: start.Add(DefaultChallengeTTL / 2), expected: true},
+		{name: "slightly in the future", now: start.Add(-DefaultClockSkew / 2), expected: true},
+		{name: "too far in the future", now: start.Add(-DefaultClockSkew - time.Second), expected: false},
+		{name: "expired within skew", now: start.Add(DefaultChallengeTTL + DefaultClockSkew/2), expected: true},
+		{name: "expired", now: start.Add(DefaultChallengeTTL + DefaultClockSkew + time.Second), expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.now = tt.now
+			if got := c.InWindow(start, c.ChallengeTTL); got != tt.expected {
+				t.Errorf("expected in window to be %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
@@ -3,9 +3,13 @@ package core
 import "time"
 
 const (
-	AppName    = "cerberus"
-	VarIPBlock = "cerberus-block"
-	VarReqID   = "cerberus-request-id"
-	Version    = "v0.4.7"
-	NonceTTL   = 2 * time.Minute
+	AppName = "cerberus"
+	// ExtAuthzAppName is the name of the Envoy external authorization app.
+	ExtAuthzAppName = "cerberus_ext_authz"
+	// VarJA4 and VarJA3 are the Caddy variables of the TLS fingerprints of the client, set by the cerberus directive.
+	VarJA4  = "cerberus-ja4"
+	VarJA3  = "cerberus-ja3"
+	Version = "v0.4.7"
+	// ReplayTTL is how long a request stashed across a challenge can be replayed.
+	ReplayTTL = 10 * time.Minute
 )
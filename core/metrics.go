@@ -0,0 +1,75 @@
+package core
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "cerberus"
+
+// Metrics holds the prometheus collectors of cerberus.
+// They are process-wide so that the values survive config reloads.
+var Metrics = struct {
+	SolverHashRate  prometheus.Histogram
+	SolverSolveTime prometheus.Histogram
+	SolverAnomalies *prometheus.CounterVec
+
+	ReplayFalsePositiveRate prometheus.Gauge
+
+	ObservedDecisions *prometheus.CounterVec
+}{
+	SolverHashRate: prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "solver",
+		Name:      "hash_rate",
+		Help:      "Hash rate (hashes per second) reported by challenge solvers.",
+		Buckets:   prometheus.ExponentialBuckets(1e4, 4, 10),
+	}),
+	SolverSolveTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "solver",
+		Name:      "solve_seconds",
+		Help:      "Solve time reported by challenge solvers.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	}),
+	SolverAnomalies: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "solver",
+		Name:      "anomalies_total",
+		Help:      "Number of solved challenges whose reported telemetry is anomalous, by reason.",
+	}, []string{"reason"}),
+	ReplayFalsePositiveRate: prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "replay",
+		Name:      "false_positive_rate",
+		Help:      "Estimated probability that a fresh nonce is rejected as already used.",
+	}),
+	ObservedDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "observe",
+		Name:      "decisions_total",
+		Help:      "Number of requests passed through in observe mode, by the status they would have had.",
+	}, []string{"status"}),
+}
+
+// RegisterMetrics registers all cerberus collectors to the given registry.
+// Collectors that are already registered are skipped.
+func RegisterMetrics(registry prometheus.Registerer) error {
+	collectors := []prometheus.Collector{
+		Metrics.SolverHashRate,
+		Metrics.SolverSolveTime,
+		Metrics.SolverAnomalies,
+		Metrics.ReplayFalsePositiveRate,
+		Metrics.ObservedDecisions,
+	}
+	for _, collector := range collectors {
+		if err := registry.Register(collector); err != nil {
+			var alreadyRegistered prometheus.AlreadyRegisteredError
+			if !errors.As(err, &alreadyRegistered) {
+				return err
+			}
+		}
+	}
+	return nil
+}
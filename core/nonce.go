@@ -0,0 +1,42 @@
+package core
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/sjtug/cerberus/internal/randpool"
+)
+
+// Nonce is a random 128-bit challenge nonce. It's large enough that random collisions never happen in practice.
+type Nonce [16]byte
+
+// NewNonce returns a new random nonce.
+func NewNonce() Nonce {
+	var n Nonce
+	randpool.Read(n[:])
+	return n
+}
+
+// ParseNonce parses a hex-encoded nonce.
+func ParseNonce(s string) (Nonce, error) {
+	var n Nonce
+	if hex.DecodedLen(len(s)) != len(n) {
+		return n, fmt.Errorf("nonce must be %d hex characters", hex.EncodedLen(len(n)))
+	}
+	_, err := hex.Decode(n[:], []byte(s))
+	return n, err
+}
+
+func (n Nonce) String() string {
+	return hex.EncodeToString(n[:])
+}
+
+func (n Nonce) MarshalText() ([]byte, error) {
+	return []byte(n.String()), nil
+}
+
+func (n *Nonce) UnmarshalText(text []byte) error {
+	var err error
+	*n, err = ParseNonce(string(text))
+	return err
+}
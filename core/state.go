@@ -1,6 +1,7 @@
 package core
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -11,7 +12,7 @@ import (
 
 	"github.com/elastic/go-freelru"
 	"github.com/google/uuid"
-	"github.com/sjtug/cerberus/internal/expiremap"
+	"github.com/sjtug/cerberus/internal/bloom"
 	"github.com/sjtug/cerberus/internal/ipblock"
 	"github.com/zeebo/xxh3"
 )
@@ -21,6 +22,9 @@ const (
 	PendingItemCost     = FreeLRUInternalCost + int64(unsafe.Sizeof(ipblock.IPBlock{})) + int64(unsafe.Sizeof(&atomic.Int32{})) + int64(unsafe.Sizeof(atomic.Int32{}))
 	BlocklistItemCost   = FreeLRUInternalCost + int64(unsafe.Sizeof(ipblock.IPBlock{}))
 	ApprovalItemCost    = FreeLRUInternalCost + int64(unsafe.Sizeof(uuid.UUID{})) + int64(unsafe.Sizeof(&atomic.Int32{})) + int64(unsafe.Sizeof(atomic.Int32{}))
+	// UsedNonceHashes is the number of hashes per nonce in the used nonce filter.
+	// It's optimal at 14.4 bits per nonce, which gives a false positive rate of 0.1%.
+	UsedNonceHashes = 10
 )
 
 func hashIPBlock(ip ipblock.IPBlock) uint32 {
@@ -38,13 +42,24 @@ func hashUUID(id uuid.UUID) uint32 {
 	return uint32(hash) // #nosec G115 -- expected truncation
 }
 
-type InstanceState struct {
-	fp        string
+// BlockState tracks the pending challenges of IP blocks, and the IP blocks that are blocked.
+type BlockState struct {
 	pending   freelru.Cache[ipblock.IPBlock, *atomic.Int32]
 	blocklist freelru.Cache[ipblock.IPBlock, struct{}]
+}
+
+type InstanceState struct {
+	*BlockState
+	fp        string
 	approval  freelru.Cache[uuid.UUID, *atomic.Int32]
-	usedNonce *expiremap.ExpireMap[uint32, struct{}]
+	usedNonce *bloom.Rotating
 	stop      chan struct{}
+
+	// config is kept to create the shadow state on first use.
+	config     Config
+	shadowOnce sync.Once
+	shadow     *BlockState
+	shadowErr  error
 }
 
 // initLRU creates and initializes an LRU cache with the given parameters
@@ -75,32 +90,10 @@ func initLRU[K comparable, V any](
 	return cache, nil
 }
 
-// initUsedNonce creates and initializes an ExpireMap for tracking used nonces
-func initUsedNonce(stop chan struct{}, purgeInterval time.Duration) *expiremap.ExpireMap[uint32, struct{}] {
-	usedNonce := expiremap.NewExpireMap[uint32, struct{}](func(x uint32) uint32 {
-		return x
-	})
-	go func() {
-		for {
-			select {
-			case <-stop:
-				return
-			case <-time.After(purgeInterval):
-				usedNonce.PurgeExpired()
-			}
-		}
-	}()
-	return usedNonce
-}
-
-func NewInstanceState(config Config) (*InstanceState, int64, int64, int64, error) {
-	uuid.EnableRandPool()
-
-	stop := make(chan struct{})
-
+// newBlockState creates a block state that takes 1/5 of the memory budget of the config.
+func newBlockState(config Config, stop chan struct{}) (*BlockState, int64, int64, error) {
 	pendingMaxMemUsage := config.MaxMemUsage / 10
 	blocklistMaxMemUsage := config.MaxMemUsage / 10
-	approvalMaxMemUsage := config.MaxMemUsage * 4 / 5
 
 	pendingElems := uint32(pendingMaxMemUsage / PendingItemCost) // #nosec G115 we trust config input
 	pending, err := initLRU[ipblock.IPBlock, *atomic.Int32](
@@ -111,7 +104,7 @@ func NewInstanceState(config Config) (*InstanceState, int64, int64, int64, error
 		37*time.Second,
 	)
 	if err != nil {
-		return nil, 0, 0, 0, err
+		return nil, 0, 0, err
 	}
 
 	blocklistElems := uint32(blocklistMaxMemUsage / BlocklistItemCost) // #nosec G115 we trust config input
@@ -122,6 +115,25 @@ func NewInstanceState(config Config) (*InstanceState, int64, int64, int64, error
 		stop,
 		61*time.Second,
 	)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	return &BlockState{
+		pending:   pending,
+		blocklist: blocklist,
+	}, int64(pendingElems), int64(blocklistElems), nil
+}
+
+func NewInstanceState(config Config) (*InstanceState, int64, int64, int64, error) {
+	uuid.EnableRandPool()
+
+	stop := make(chan struct{})
+
+	usedNonceMaxMemUsage := config.MaxMemUsage / 32
+	approvalMaxMemUsage := config.MaxMemUsage*4/5 - usedNonceMaxMemUsage
+
+	blockState, pendingElems, blocklistElems, err := newBlockState(config, stop)
 	if err != nil {
 		return nil, 0, 0, 0, err
 	}
@@ -138,25 +150,36 @@ func NewInstanceState(config Config) (*InstanceState, int64, int64, int64, error
 		return nil, 0, 0, 0, err
 	}
 
-	usedNonce := initUsedNonce(stop, 41*time.Second)
+	// Nonces must be remembered for as long as challenges are valid.
+	usedNonce := bloom.NewRotating(usedNonceMaxMemUsage, UsedNonceHashes, config.UsedNonceTTL(), config.Now)
 
 	fp := sha256.Sum256(config.ed25519Key.Seed())
 
 	return &InstanceState{
-		fp:        hex.EncodeToString(fp[:]),
-		pending:   pending,
-		blocklist: blocklist,
-		approval:  approval,
-		usedNonce: usedNonce,
-		stop:      stop,
-	}, int64(pendingElems), int64(blocklistElems), int64(approvalElems), nil
+		BlockState: blockState,
+		fp:         hex.EncodeToString(fp[:]),
+		approval:   approval,
+		usedNonce:  usedNonce,
+		stop:       stop,
+		config:     config,
+	}, pendingElems, blocklistElems, int64(approvalElems), nil
+}
+
+// Shadow returns the shadow block state, which tracks what would have been pending and blocked in observe mode without
+// affecting clients. It's created on first use, as it takes as much memory as the block state, i.e. 1/5 of MaxMemUsage
+// on top of it.
+func (s *InstanceState) Shadow() (*BlockState, error) {
+	s.shadowOnce.Do(func() {
+		s.shadow, _, _, s.shadowErr = newBlockState(s.config, s.stop)
+	})
+	return s.shadow, s.shadowErr
 }
 
 func (s *InstanceState) GetFingerprint() string {
 	return s.fp
 }
 
-func (s *InstanceState) IncPending(ip ipblock.IPBlock) int32 {
+func (s *BlockState) IncPending(ip ipblock.IPBlock) int32 {
 	counter, ok := s.pending.Get(ip)
 	if ok {
 		return counter.Add(1)
@@ -168,7 +191,7 @@ func (s *InstanceState) IncPending(ip ipblock.IPBlock) int32 {
 	return 1
 }
 
-func (s *InstanceState) DecPending(ip ipblock.IPBlock) int32 {
+func (s *BlockState) DecPending(ip ipblock.IPBlock) int32 {
 	counter, ok := s.pending.Get(ip)
 	if ok {
 		count := counter.Add(-1)
@@ -182,15 +205,29 @@ func (s *InstanceState) DecPending(ip ipblock.IPBlock) int32 {
 	return 0
 }
 
-func (s *InstanceState) RemovePending(ip ipblock.IPBlock) bool {
+// GetPending returns the pending counter of an IP block without refreshing it.
+func (s *BlockState) GetPending(ip ipblock.IPBlock) int32 {
+	counter, ok := s.pending.Peek(ip)
+	if ok {
+		return counter.Load()
+	}
+	return 0
+}
+
+func (s *BlockState) RemovePending(ip ipblock.IPBlock) bool {
 	return s.pending.Remove(ip)
 }
 
-func (s *InstanceState) InsertBlocklist(ip ipblock.IPBlock) {
+func (s *BlockState) InsertBlocklist(ip ipblock.IPBlock) {
 	s.blocklist.Add(ip, struct{}{})
 }
 
-func (s *InstanceState) ContainsBlocklist(ip ipblock.IPBlock) bool {
+// InsertBlocklistFor blocks an IP block for the given time instead of BlockTTL.
+func (s *BlockState) InsertBlocklistFor(ip ipblock.IPBlock, ttl time.Duration) {
+	s.blocklist.AddWithLifetime(ip, struct{}{}, ttl)
+}
+
+func (s *BlockState) ContainsBlocklist(ip ipblock.IPBlock) bool {
 	_, ok := s.blocklist.Get(ip)
 	return ok
 }
@@ -206,6 +243,12 @@ func (s *InstanceState) IssueApproval(n int32) uuid.UUID {
 	return id
 }
 
+// PeekApproval reports whether the approval ID is valid and has accesses left, without using one.
+func (s *InstanceState) PeekApproval(id uuid.UUID) bool {
+	counter, ok := s.approval.Peek(id)
+	return ok && counter.Load() > 0
+}
+
 // DecApproval decrements the counter of the approval ID and returns whether the ID is still valid
 func (s *InstanceState) DecApproval(id uuid.UUID) bool {
 	counter, ok := s.approval.Get(id)
@@ -220,10 +263,13 @@ func (s *InstanceState) DecApproval(id uuid.UUID) bool {
 	return false
 }
 
-// InsertUsedNonce inserts a nonce into the usedNonce map.
+// InsertUsedNonce marks a nonce as used.
 // Returns true if the nonce was inserted, false if it was already present.
-func (s *InstanceState) InsertUsedNonce(nonce uint32) bool {
-	return s.usedNonce.SetIfAbsent(nonce, struct{}{}, NonceTTL)
+// Unused nonces are falsely reported as present at the rate exported as the replay false positive rate metric.
+func (s *InstanceState) InsertUsedNonce(nonce Nonce) bool {
+	inserted := s.usedNonce.InsertIfAbsent(nonce[:])
+	Metrics.ReplayFalsePositiveRate.Set(s.usedNonce.FalsePositiveRate())
+	return inserted
 }
 
 func (s *InstanceState) Close() {
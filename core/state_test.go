@@ -16,12 +16,13 @@ func newTestState(t *testing.T) *InstanceState {
 	}
 
 	state, _, _, _, err := NewInstanceState(Config{
-		MaxMemUsage: 10 << 20,  // 10MB for pending
-		PendingTTL:  time.Hour, // 1 hour TTL for pending
-		BlockTTL:    time.Hour, // 1 hour TTL for blocklist
-		ApprovalTTL: time.Hour, // 1 hour TTL for approved
-		ed25519Pub:  pub,
-		ed25519Key:  priv,
+		MaxMemUsage:  10 << 20,    // 10MB for pending
+		PendingTTL:   time.Hour,   // 1 hour TTL for pending
+		BlockTTL:     time.Hour,   // 1 hour TTL for blocklist
+		ApprovalTTL:  time.Hour,   // 1 hour TTL for approved
+		ChallengeTTL: time.Minute, // 1 minute TTL for used nonces
+		ed25519Pub:   pub,
+		ed25519Key:   priv,
 	})
 	if err != nil {
 		t.Fatalf("failed to create instance state: %v", err)
@@ -200,3 +201,144 @@ func TestBlocklist(t *testing.T) {
 		})
 	}
 }
+
+func TestBlocklistFor(t *testing.T) {
+	state := newTestState(t)
+	defer state.Close()
+
+	ipBlock := newTestIPBlock(t, "192.168.1.1")
+	state.InsertBlocklistFor(ipBlock, 50*time.Millisecond)
+	if !state.ContainsBlocklist(ipBlock) {
+		t.Fatal("expected IP to be in blocklist after insertion")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if state.ContainsBlocklist(ipBlock) {
+		t.Error("expected IP to leave the blocklist after its own TTL")
+	}
+}
+
+func TestGetPending(t *testing.T) {
+	state := newTestState(t)
+	defer state.Close()
+
+	ipBlock := newTestIPBlock(t, "192.168.1.1")
+	if got := state.GetPending(ipBlock); got != 0 {
+		t.Errorf("expected no pending challenges initially, got %d", got)
+	}
+
+	state.IncPending(ipBlock)
+	state.IncPending(ipBlock)
+	if got := state.GetPending(ipBlock); got != 2 {
+		t.Errorf("expected 2 pending challenges, got %d", got)
+	}
+}
+
+func TestPeekApproval(t *testing.T) {
+	state := newTestState(t)
+	defer state.Close()
+
+	id := state.IssueApproval(1)
+	if !state.PeekApproval(id) || !state.PeekApproval(id) {
+		t.Fatal("expected peeking an approval not to use it")
+	}
+	if !state.DecApproval(id) {
+		t.Fatal("expected approval to have one access")
+	}
+	if state.PeekApproval(id) {
+		t.Error("expected used up approval to be invalid")
+	}
+}
+
+func TestShadow(t *testing.T) {
+	state := newTestState(t)
+	defer state.Close()
+
+	shadow, err := state.Shadow()
+	if err != nil {
+		t.Fatalf("failed to create shadow state: %v", err)
+	}
+	if again, _ := state.Shadow(); again != shadow {
+		t.Error("expected the shadow state to be created once")
+	}
+
+	ipBlock := newTestIPBlock(t, "192.168.1.1")
+	shadow.IncPending(ipBlock)
+	shadow.InsertBlocklist(ipBlock)
+	if state.GetPending(ipBlock) != 0 || state.ContainsBlocklist(ipBlock) {
+		t.Error("expected the shadow state to be separate from the state")
+	}
+	if shadow.GetPending(ipBlock) != 1 || !shadow.ContainsBlocklist(ipBlock) {
+		t.Error("expected the shadow state to track pending and blocked IP blocks")
+	}
+}
+
+func TestUsedNonce(t *testing.T) {
+	state := newTestState(t)
+	defer state.Close()
+
+	nonce := NewNonce()
+	if !state.InsertUsedNonce(nonce) {
+		t.Fatal("expected fresh nonce to be inserted")
+	}
+	if state.InsertUsedNonce(nonce) {
+		t.Error("expected used nonce to be rejected")
+	}
+	if !state.InsertUsedNonce(NewNonce()) {
+		t.Error("expected another fresh nonce to be inserted")
+	}
+}
+
+func TestUsedNonceExpiry(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key: %v", err)
+	}
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	state, _, _, _, err := NewInstanceState(Config{
+		MaxMemUsage:  10 << 20,
+		ChallengeTTL: time.Minute,
+		ClockSkew:    time.Second,
+		Clock:        clock,
+		ed25519Pub:   pub,
+		ed25519Key:   priv,
+	})
+	if err != nil {
+		t.Fatalf("failed to create instance state: %v", err)
+	}
+	defer state.Close()
+
+	nonce := NewNonce()
+	if !state.InsertUsedNonce(nonce) {
+		t.Fatal("expected fresh nonce to be inserted")
+	}
+
+	// Used nonces are remembered for as long as challenges can be answered or swapped.
+	clock.now = clock.now.Add(2*time.Minute + 2*time.Second)
+	if state.InsertUsedNonce(nonce) {
+		t.Error("expected used nonce to be remembered within its validity window")
+	}
+
+	clock.now = clock.now.Add(3 * time.Minute)
+	if !state.InsertUsedNonce(nonce) {
+		t.Error("expected used nonce to be forgotten after its validity window")
+	}
+}
+
+func TestParseNonce(t *testing.T) {
+	nonce := NewNonce()
+	parsed, err := ParseNonce(nonce.String())
+	if err != nil {
+		t.Fatalf("failed to parse nonce: %v", err)
+	}
+	if parsed != nonce {
+		t.Errorf("expected %s, got %s", nonce, parsed)
+	}
+
+	for _, invalid := range []string{"", "1234", nonce.String() + "00", "zz" + nonce.String()[2:]} {
+		if _, err := ParseNonce(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
@@ -31,6 +31,10 @@ func (c *App) Provision(context caddy.Context) error {
 
 	c.instance = instance
 
+	if err := core.RegisterMetrics(context.GetMetricsRegistry()); err != nil {
+		return err
+	}
+
 	return nil
 }
 
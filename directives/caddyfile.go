@@ -9,7 +9,9 @@ import (
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/dustin/go-humanize"
 	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/handler"
 	"github.com/sjtug/cerberus/internal/ipblock"
+	"github.com/sjtug/cerberus/internal/policy"
 )
 
 func (c *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
@@ -26,6 +28,216 @@ func (c *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Errf("difficulty must be an integer")
 			}
 			c.Difficulty = difficulty
+		case "difficulty_bits":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			difficultyBits, ok := d.ScalarVal().(int)
+			if !ok {
+				return d.Errf("difficulty_bits must be an integer")
+			}
+			c.DifficultyBits = difficultyBits
+		case "puzzles":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			puzzles, ok := d.ScalarVal().(int)
+			if !ok {
+				return d.Errf("puzzles must be an integer")
+			}
+			c.Puzzles = puzzles
+		case "challenge_status":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			challengeStatus, ok := d.ScalarVal().(int)
+			if !ok {
+				return d.Errf("challenge_status must be an integer")
+			}
+			c.ChallengeStatus = challengeStatus
+		case "challenge_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			challengeTTLRaw, ok := d.ScalarVal().(string)
+			if !ok {
+				return d.Errf("challenge_ttl must be a string")
+			}
+			challengeTTL, err := time.ParseDuration(challengeTTLRaw)
+			if err != nil {
+				return d.Errf("challenge_ttl must be a valid duration: %v", err)
+			}
+			c.ChallengeTTL = challengeTTL
+		case "clock_skew":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			clockSkewRaw, ok := d.ScalarVal().(string)
+			if !ok {
+				return d.Errf("clock_skew must be a string")
+			}
+			clockSkew, err := time.ParseDuration(clockSkewRaw)
+			if err != nil {
+				return d.Errf("clock_skew must be a valid duration: %v", err)
+			}
+			c.ClockSkew = clockSkew
+		case "max_hash_rate":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			switch maxHashRate := d.ScalarVal().(type) {
+			case int:
+				c.MaxHashRate = int64(maxHashRate)
+			case string:
+				rate, _, err := humanize.ParseSI(maxHashRate)
+				if err != nil {
+					return d.Errf("max_hash_rate must be a valid rate: %v", err)
+				}
+				c.MaxHashRate = int64(rate)
+			default:
+				return d.Errf("max_hash_rate must be an integer or a string")
+			}
+		case "wait_delay":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			waitDelayRaw, ok := d.ScalarVal().(string)
+			if !ok {
+				return d.Errf("wait_delay must be a string")
+			}
+			waitDelay, err := time.ParseDuration(waitDelayRaw)
+			if err != nil {
+				return d.Errf("wait_delay must be a valid duration: %v", err)
+			}
+			c.WaitDelay = waitDelay
+		case "captcha":
+			if !d.NextArg() {
+				c.Captcha = true
+				continue
+			}
+			captcha, ok := d.ScalarVal().(bool)
+			if !ok {
+				return d.Errf("captcha must be a boolean")
+			}
+			c.Captcha = captcha
+		case "replay_body_limit":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			replayBodyLimitRaw, ok := d.ScalarVal().(string)
+			if !ok {
+				return d.Errf("replay_body_limit must be a string")
+			}
+			replayBodyLimit, err := humanize.ParseBytes(replayBodyLimitRaw)
+			if err != nil {
+				return d.Errf("replay_body_limit must be a valid size: %v", err)
+			}
+			c.ReplayBodyLimit = int64(replayBodyLimit) // #nosec G115 -- trusted input
+		case "download_patterns":
+			patterns := d.RemainingArgs()
+			if len(patterns) == 0 {
+				return d.ArgErr()
+			}
+			c.DownloadPatterns = append(c.DownloadPatterns, patterns...)
+		case "download_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			downloadTTLRaw, ok := d.ScalarVal().(string)
+			if !ok {
+				return d.Errf("download_ttl must be a string")
+			}
+			downloadTTL, err := time.ParseDuration(downloadTTLRaw)
+			if err != nil {
+				return d.Errf("download_ttl must be a valid duration: %v", err)
+			}
+			c.DownloadTTL = downloadTTL
+		case "download_uses":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			downloadUses, ok := d.ScalarVal().(int)
+			if !ok {
+				return d.Errf("download_uses must be an integer")
+			}
+			c.DownloadUses = int32(downloadUses) // #nosec G115 -- trusted input
+		case "blocked_fingerprints":
+			fingerprints := d.RemainingArgs()
+			if len(fingerprints) == 0 {
+				return d.ArgErr()
+			}
+			c.BlockedFingerprints = append(c.BlockedFingerprints, fingerprints...)
+		case "fingerprint_difficulty_bits":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			fingerprint := d.Val()
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			difficultyBits, ok := d.ScalarVal().(int)
+			if !ok {
+				return d.Errf("fingerprint_difficulty_bits must be followed by a fingerprint and an integer")
+			}
+			if c.FingerprintDifficultyBits == nil {
+				c.FingerprintDifficultyBits = make(map[string]int)
+			}
+			c.FingerprintDifficultyBits[fingerprint] = difficultyBits
+		case "bind_fingerprint":
+			if !d.NextArg() {
+				c.BindFingerprint = true
+				continue
+			}
+			bindFingerprint, ok := d.ScalarVal().(bool)
+			if !ok {
+				return d.Errf("bind_fingerprint must be a boolean")
+			}
+			c.BindFingerprint = bindFingerprint
+		case "bot_score":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				name := d.Val()
+				switch name {
+				case "challenge_threshold", "harder_threshold", "harder_bits", "block_threshold":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					value, ok := d.ScalarVal().(int)
+					if !ok {
+						return d.Errf("%s must be an integer", name)
+					}
+					switch name {
+					case "challenge_threshold":
+						c.BotScore.ChallengeThreshold = value
+					case "harder_threshold":
+						c.BotScore.HarderThreshold = value
+					case "harder_bits":
+						c.BotScore.HarderBits = value
+					case "block_threshold":
+						c.BotScore.BlockThreshold = value
+					}
+				case "weight":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					check := d.Val()
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					weight, ok := d.ScalarVal().(int)
+					if !ok {
+						return d.Errf("weight must be followed by a check name and an integer")
+					}
+					if c.BotScore.Weights == nil {
+						c.BotScore.Weights = make(map[string]int)
+					}
+					c.BotScore.Weights[check] = weight
+				default:
+					return d.Errf("unknown bot_score subdirective '%s'", name)
+				}
+			}
 		case "drop":
 			if !d.NextArg() {
 				c.Drop = true
@@ -45,6 +257,15 @@ func (c *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Errf("ed25519_key_file must be a string")
 			}
 			c.Ed25519KeyFile = ed25519KeyFile
+		case "siteverify_secret":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			secret, ok := d.ScalarVal().(string)
+			if !ok {
+				return d.Errf("siteverify_secret must be a string")
+			}
+			c.SiteverifySecret = secret
 		case "max_pending":
 			if !d.NextArg() {
 				return d.ArgErr()
@@ -170,6 +391,26 @@ func (c *App) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Errf("mail must be a string")
 			}
 			c.Mail = mail
+		case "rollout":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rollout := core.RolloutConfig{}
+			switch percent := d.ScalarVal().(type) {
+			case int:
+				rollout.Percent = float64(percent)
+			case float64:
+				rollout.Percent = percent
+			default:
+				return d.Errf("rollout must be followed by a percentage")
+			}
+			if d.NextArg() {
+				rollout.By = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Rollout = &rollout
 		default:
 			return d.Errf("unknown subdirective '%s'", d.Val())
 		}
@@ -211,6 +452,52 @@ func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.Errf("block_only must be a boolean")
 			}
 			m.BlockOnly = blockOnly
+		case "observe":
+			if !d.NextArg() {
+				m.Observe = true
+				continue
+			}
+			observe, ok := d.ScalarVal().(bool)
+			if !ok {
+				return d.Errf("observe must be a boolean")
+			}
+			m.Observe = observe
+		case "policy":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				rule := handler.PolicyRule{Action: policy.Action(d.Val())}
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				rule.Expression = d.Val()
+				switch rule.Action {
+				case policy.Allow:
+				case policy.Challenge:
+					if d.NextArg() {
+						difficultyBits, ok := d.ScalarVal().(int)
+						if !ok {
+							return d.Errf("challenge difficulty must be an integer")
+						}
+						rule.DifficultyBits = difficultyBits
+					}
+				case policy.Block:
+					if d.NextArg() {
+						blockTTL, err := time.ParseDuration(d.Val())
+						if err != nil {
+							return d.Errf("block ttl must be a valid duration: %v", err)
+						}
+						rule.BlockTTL = blockTTL
+					}
+				default:
+					return d.Errf("unknown policy action '%s'", rule.Action)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Policy = append(m.Policy, rule)
+			}
 		default:
 			return d.Errf("unknown subdirective '%s'", d.Val())
 		}
@@ -235,3 +522,62 @@ func ParseCaddyFileEndpoint(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler
 	err := e.UnmarshalCaddyfile(h.Dispenser)
 	return &e, err
 }
+
+func (t *TLSFingerprint) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume the wrapper name
+
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	return nil
+}
+
+func (a *ExtAuthz) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume the directive
+
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "listen":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			listen, ok := d.ScalarVal().(string)
+			if !ok {
+				return d.Errf("listen must be a string")
+			}
+			a.Listen = listen
+		case "base_url":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			baseURL, ok := d.ScalarVal().(string)
+			if !ok {
+				return d.Errf("base_url must be a string")
+			}
+			a.BaseURL = baseURL
+		case "block_only":
+			if !d.NextArg() {
+				a.BlockOnly = true
+				continue
+			}
+			blockOnly, ok := d.ScalarVal().(bool)
+			if !ok {
+				return d.Errf("block_only must be a boolean")
+			}
+			a.BlockOnly = blockOnly
+		default:
+			return d.Errf("unknown subdirective '%s'", d.Val())
+		}
+	}
+	return nil
+}
+
+func ParseCaddyFileExtAuthz(d *caddyfile.Dispenser, _ any) (any, error) {
+	var a ExtAuthz
+	err := a.UnmarshalCaddyfile(d)
+	return httpcaddyfile.App{
+		Name:  core.ExtAuthzAppName,
+		Value: caddyconfig.JSON(a, nil),
+	}, err
+}
@@ -0,0 +1,266 @@
+package directives
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/handler"
+	"go.uber.org/zap"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ExtAuthz is an Envoy external authorization (ext_authz) server, which makes the same decisions as the middleware for
+// traffic that doesn't pass through Caddy. It runs as a separate app with its own gRPC listener.
+type ExtAuthz struct {
+	// The network address to listen on for gRPC connections from Envoy, e.g. "127.0.0.1:9001".
+	Listen string `json:"listen,omitempty"`
+	// The base URL for the challenge. Envoy must route it to a cerberus_endpoint handler on the protected host.
+	BaseURL string `json:"base_url,omitempty"`
+	// If true, the server will not perform any challenge. It will only block known bad IPs.
+	BlockOnly bool `json:"block_only,omitempty"`
+
+	ctx    caddy.Context
+	logger *zap.Logger
+	server *grpc.Server
+}
+
+// extAuthzServer implements the Envoy authorization service on top of the middleware.
+type extAuthzServer struct {
+	authv3.UnimplementedAuthorizationServer
+
+	middleware *handler.Middleware
+	logger     *zap.Logger
+}
+
+// errIncompleteBody is returned when reading a request body that Envoy didn't send in full.
+var errIncompleteBody = errors.New("request body was not sent in full")
+
+type incompleteBody struct{}
+
+func (incompleteBody) Read([]byte) (int, error) {
+	return 0, errIncompleteBody
+}
+
+func (incompleteBody) Close() error {
+	return nil
+}
+
+// newCheckHTTPRequest converts the attributes of a check request to the original HTTP request.
+// The client IP is the downstream address seen by Envoy, which already accounts for xff_num_trusted_hops.
+func newCheckHTTPRequest(ctx context.Context, check *authv3.CheckRequest) (*http.Request, error) {
+	attrs := check.GetAttributes().GetRequest().GetHttp()
+	if attrs == nil {
+		return nil, errors.New("check request has no HTTP attributes")
+	}
+
+	clientIP := check.GetAttributes().GetSource().GetAddress().GetSocketAddress().GetAddress()
+
+	r, err := http.NewRequestWithContext(ctx, attrs.GetMethod(), attrs.GetPath(), http.NoBody)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	r.RequestURI = attrs.GetPath()
+	r.Host = attrs.GetHost()
+	r.RemoteAddr = net.JoinHostPort(clientIP, "0")
+	if major, minor, ok := http.ParseHTTPVersion(attrs.GetProtocol()); ok {
+		r.Proto, r.ProtoMajor, r.ProtoMinor = attrs.GetProtocol(), major, minor
+	}
+
+	for key, value := range attrs.GetHeaders() {
+		if strings.HasPrefix(key, ":") {
+			continue // pseudo-headers
+		}
+		r.Header.Set(key, value)
+	}
+
+	// Envoy only sends the body if with_request_body is configured, and may truncate it.
+	body := attrs.GetRawBody()
+	if len(body) == 0 {
+		body = []byte(attrs.GetBody())
+	}
+	size := attrs.GetSize()
+	complete := r.Header.Get("X-Envoy-Auth-Partial-Body") != "true" && (size == int64(len(body)) || size < 0 && len(body) > 0)
+	if complete {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	} else {
+		r.Body = incompleteBody{}
+		r.ContentLength = size
+	}
+
+	return r, nil
+}
+
+// headerOptions converts response headers to header options of a check response.
+// The Connection header is left out, as Envoy manages its downstream connections itself.
+func headerOptions(header http.Header) []*corev3.HeaderValueOption {
+	var options []*corev3.HeaderValueOption
+	for key, values := range header {
+		if key == "Connection" {
+			continue
+		}
+		for _, value := range values {
+			options = append(options, &corev3.HeaderValueOption{
+				Header:       &corev3.HeaderValue{Key: strings.ToLower(key), Value: value},
+				AppendAction: corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD,
+			})
+		}
+	}
+	return options
+}
+
+// serve runs the middleware on the request, and reports whether the request was passed to the next handler.
+func (s *extAuthzServer) serve(w http.ResponseWriter, r *http.Request) (allowed bool, err error) {
+	defer func() {
+		// The connection belongs to Envoy and can't be dropped. Deny the request with an empty response instead.
+		if rec := recover(); rec != nil {
+			if rec != http.ErrAbortHandler {
+				panic(rec)
+			}
+			w.WriteHeader(http.StatusForbidden)
+			allowed, err = false, nil
+		}
+	}()
+
+	next := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		allowed = true
+	})
+	err = s.middleware.Serve(w, r, next)
+	return allowed, err
+}
+
+func (s *extAuthzServer) Check(ctx context.Context, check *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	r, err := newCheckHTTPRequest(ctx, check)
+	if err != nil {
+		s.logger.Debug("invalid check request", zap.Error(err))
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	allowed, err := s.serve(rec, r)
+	if err != nil {
+		s.logger.Error("failed to check request", zap.Error(err))
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+
+	if allowed {
+		// Headers set by the middleware, e.g. the status header, are added to the response to the client.
+		return &authv3.CheckResponse{
+			Status: &rpcstatus.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{
+				OkResponse: &authv3.OkHttpResponse{
+					ResponseHeadersToAdd: headerOptions(rec.Header()),
+				},
+			},
+		}, nil
+	}
+
+	// The challenge page or the failure response is sent to the client in place of the upstream response.
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(codes.PermissionDenied)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(rec.Code)},
+				Headers: headerOptions(rec.Header()),
+				Body:    rec.Body.String(),
+			},
+		},
+	}, nil
+}
+
+func (a *ExtAuthz) Provision(ctx caddy.Context) error {
+	a.ctx = ctx
+	a.logger = ctx.Logger()
+
+	appRaw, err := ctx.App(core.AppName)
+	if err != nil {
+		return err
+	}
+	app := appRaw.(*App)
+
+	instance := app.GetInstance()
+	if instance == nil {
+		return errors.New("no global cerberus app found")
+	}
+
+	// The client IP is the remote address of the request built from the check request.
+	middleware := handler.NewMiddleware(instance, a.BaseURL)
+	middleware.BlockOnly = a.BlockOnly
+	middleware.Logger = a.logger
+
+	a.server = grpc.NewServer()
+	authv3.RegisterAuthorizationServer(a.server, &extAuthzServer{
+		middleware: middleware,
+		logger:     a.logger,
+	})
+
+	return nil
+}
+
+func (a *ExtAuthz) Validate() error {
+	if a.Listen == "" {
+		return fmt.Errorf("listen is required")
+	}
+	if a.BaseURL == "" {
+		return fmt.Errorf("base_url is required")
+	}
+	return nil
+}
+
+func (a *ExtAuthz) Start() error {
+	addr, err := caddy.ParseNetworkAddress(a.Listen)
+	if err != nil {
+		return fmt.Errorf("invalid listen address: %w", err)
+	}
+	if addr.PortRangeSize() != 1 {
+		return fmt.Errorf("listen address must have a single port: %s", a.Listen)
+	}
+
+	ln, err := addr.Listen(a.ctx, 0, net.ListenConfig{})
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", a.Listen, err)
+	}
+
+	a.logger.Info("serving envoy external authorization", zap.String("address", addr.JoinHostPort(0)))
+	go func() {
+		if err := a.server.Serve(ln.(net.Listener)); err != nil {
+			a.logger.Error("external authorization server stopped", zap.Error(err))
+		}
+	}()
+
+	return nil
+}
+
+func (a *ExtAuthz) Stop() error {
+	a.server.GracefulStop()
+	return nil
+}
+
+func (ExtAuthz) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  core.ExtAuthzAppName,
+		New: func() caddy.Module { return new(ExtAuthz) },
+	}
+}
+
+var (
+	_ caddy.App                  = (*ExtAuthz)(nil)
+	_ caddy.Provisioner          = (*ExtAuthz)(nil)
+	_ caddy.Validator            = (*ExtAuthz)(nil)
+	_ authv3.AuthorizationServer = (*extAuthzServer)(nil)
+)
@@ -0,0 +1,184 @@
+package directives
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/handler"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestAuthorizationClient serves the ext_authz server over an in-memory connection and returns a client for it.
+func newTestAuthorizationClient(t *testing.T) (*core.Instance, authv3.AuthorizationClient) {
+	t.Helper()
+
+	config := core.Config{MaxMemUsage: 16 << 20, ChallengeStatus: http.StatusUnauthorized}
+	if err := config.Provision(zap.NewNop()); err != nil {
+		t.Fatalf("failed to provision config: %v", err)
+	}
+	state, _, _, _, err := core.NewInstanceState(config)
+	if err != nil {
+		t.Fatalf("failed to create instance state: %v", err)
+	}
+	t.Cleanup(state.Close)
+	instance := &core.Instance{Config: config, InstanceState: state}
+
+	middleware := handler.NewMiddleware(instance, "/.cerberus")
+	err = middleware.SetPolicy([]handler.PolicyRule{
+		{Expression: `path.startsWith("/public/")`, Action: "allow"},
+		{Expression: `path == "/admin"`, Action: "block"},
+	})
+	if err != nil {
+		t.Fatalf("failed to set policy: %v", err)
+	}
+
+	ln := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(server, &extAuthzServer{middleware: middleware, logger: zap.NewNop()})
+	go func() {
+		_ = server.Serve(ln)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return instance, authv3.NewAuthorizationClient(conn)
+}
+
+func newTestCheckRequest(path string, headers map[string]string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Source: &authv3.AttributeContext_Peer{
+				Address: &corev3.Address{
+					Address: &corev3.Address_SocketAddress{
+						SocketAddress: &corev3.SocketAddress{Address: "192.0.2.1"},
+					},
+				},
+			},
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method:   http.MethodGet,
+					Path:     path,
+					Host:     "example.com",
+					Protocol: "HTTP/1.1",
+					Headers:  headers,
+				},
+			},
+		},
+	}
+}
+
+// headerValue returns the value of a header in header options, and whether it's present.
+func headerValue(options []*corev3.HeaderValueOption, key string) (string, bool) {
+	for _, option := range options {
+		if option.GetHeader().GetKey() == key {
+			return option.GetHeader().GetValue(), true
+		}
+	}
+	return "", false
+}
+
+func TestExtAuthzCheck(t *testing.T) {
+	instance, client := newTestAuthorizationClient(t)
+	statusHeader := strings.ToLower(instance.HeaderName)
+
+	t.Run("allow", func(t *testing.T) {
+		resp, err := client.Check(context.Background(), newTestCheckRequest("/public/app.js", map[string]string{"accept": "*/*"}))
+		if err != nil {
+			t.Fatalf("check failed: %v", err)
+		}
+		if code := codes.Code(resp.GetStatus().GetCode()); code != codes.OK {
+			t.Fatalf("expected OK, got %s", code)
+		}
+		if value, _ := headerValue(resp.GetOkResponse().GetResponseHeadersToAdd(), statusHeader); value != "PASS" {
+			t.Errorf("expected the status header to be added to the response, got %q", value)
+		}
+	})
+
+	t.Run("challenge page", func(t *testing.T) {
+		resp, err := client.Check(context.Background(), newTestCheckRequest("/", map[string]string{"accept": "text/html"}))
+		if err != nil {
+			t.Fatalf("check failed: %v", err)
+		}
+		if code := codes.Code(resp.GetStatus().GetCode()); code != codes.PermissionDenied {
+			t.Fatalf("expected PermissionDenied, got %s", code)
+		}
+		denied := resp.GetDeniedResponse()
+		if code := denied.GetStatus().GetCode(); int(code) != http.StatusUnauthorized {
+			t.Errorf("expected the challenge status 401, got %d", code)
+		}
+		if value, _ := headerValue(denied.GetHeaders(), statusHeader); value != "CHALLENGE" {
+			t.Errorf("expected status header CHALLENGE, got %q", value)
+		}
+		if value, _ := headerValue(denied.GetHeaders(), "content-type"); !strings.HasPrefix(value, "text/html") {
+			t.Errorf("expected an HTML challenge page, got content type %q", value)
+		}
+		if !strings.Contains(denied.GetBody(), "/.cerberus/") {
+			t.Error("expected the challenge page to refer to the endpoint")
+		}
+	})
+
+	t.Run("challenge pointer", func(t *testing.T) {
+		resp, err := client.Check(context.Background(), newTestCheckRequest("/api", map[string]string{"accept": "application/json"}))
+		if err != nil {
+			t.Fatalf("check failed: %v", err)
+		}
+		denied := resp.GetDeniedResponse()
+		if code := denied.GetStatus().GetCode(); int(code) != http.StatusForbidden {
+			t.Errorf("expected status 403, got %d", code)
+		}
+		if value, _ := headerValue(denied.GetHeaders(), strings.ToLower(handler.ChallengeHeaderName)); value != "/.cerberus/challenge" {
+			t.Errorf("expected the challenge header to point to the endpoint, got %q", value)
+		}
+		if !strings.Contains(denied.GetBody(), `"outcome":"challenge"`) {
+			t.Errorf("expected a JSON challenge body, got %q", denied.GetBody())
+		}
+	})
+
+	t.Run("deny", func(t *testing.T) {
+		resp, err := client.Check(context.Background(), newTestCheckRequest("/admin", map[string]string{"accept": "text/html"}))
+		if err != nil {
+			t.Fatalf("check failed: %v", err)
+		}
+		if code := codes.Code(resp.GetStatus().GetCode()); code != codes.PermissionDenied {
+			t.Fatalf("expected PermissionDenied, got %s", code)
+		}
+		denied := resp.GetDeniedResponse()
+		if code := denied.GetStatus().GetCode(); int(code) != http.StatusForbidden {
+			t.Errorf("expected status 403, got %d", code)
+		}
+		if value, _ := headerValue(denied.GetHeaders(), statusHeader); value != "BLOCKED" {
+			t.Errorf("expected status header BLOCKED, got %q", value)
+		}
+		if _, ok := headerValue(denied.GetHeaders(), "connection"); ok {
+			t.Error("expected the Connection header to be left to Envoy")
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := client.Check(context.Background(), &authv3.CheckRequest{})
+		if code := status.Code(err); code != codes.InvalidArgument {
+			t.Errorf("expected InvalidArgument, got %v", err)
+		}
+	})
+}
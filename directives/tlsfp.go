@@ -0,0 +1,52 @@
+package directives
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/handler"
+	"github.com/sjtug/cerberus/internal/tlsfp"
+)
+
+// TLSFingerprint is a listener wrapper that computes the JA3 and JA4 fingerprints of TLS client hellos.
+// It must be placed before the tls listener wrapper, so that it sees the client hello.
+type TLSFingerprint struct{}
+
+func (TLSFingerprint) WrapListener(ln net.Listener) net.Listener {
+	return tlsfp.Listener{Listener: ln}
+}
+
+func (TLSFingerprint) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.listeners.cerberus_tls_fingerprint",
+		New: func() caddy.Module { return new(TLSFingerprint) },
+	}
+}
+
+// getTLSFingerprint returns the TLS fingerprint of the connection of the request, if it was accepted through the
+// cerberus_tls_fingerprint listener wrapper.
+func getTLSFingerprint(r *http.Request) handler.TLSFingerprint {
+	conn, ok := r.Context().Value(caddyhttp.ConnCtxKey).(net.Conn)
+	if !ok {
+		return handler.TLSFingerprint{}
+	}
+
+	fp, _ := tlsfp.FromConn(conn)
+	return handler.TLSFingerprint{JA3: fp.JA3, JA4: fp.JA4}
+}
+
+// setTLSFingerprintVars exposes the TLS fingerprint of the request to other handlers and placeholders as variables.
+func setTLSFingerprintVars(r *http.Request) {
+	fp := getTLSFingerprint(r)
+	if fp.JA4 != "" {
+		caddyhttp.SetVar(r.Context(), core.VarJA4, fp.JA4)
+	}
+	if fp.JA3 != "" {
+		caddyhttp.SetVar(r.Context(), core.VarJA3, fp.JA3)
+	}
+}
+
+var _ caddy.ListenerWrapper = (*TLSFingerprint)(nil)
@@ -0,0 +1,678 @@
+package handler
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/invopop/ctxi18n"
+	"github.com/invopop/ctxi18n/i18n"
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/internal/botscore"
+	"github.com/sjtug/cerberus/internal/ipblock"
+	"github.com/sjtug/cerberus/web"
+	"github.com/zeebo/blake3"
+	"go.uber.org/zap"
+)
+
+const (
+	IV1 = "/L4y6KgWa8vHEujU3O6JyI8osQxwh1nE0Eoay4nD3vw/y36eSFT0s/GTGfrngN6+"
+	IV2 = "KHo5hHR3ZfisR7xeG1gJwO3LSc1cYyDUQ5+StoAjV8jLhp01NBNi4joHYTWXDqF0"
+	IV3 = "DuGh1JYIioVAsD+Bq+Mx0V7E5dBbkahQwRAvKuWtkVj7ca87NBI6zELqswP6mOSt"
+	IV4 = "4yJoI6LeLYcyKcpZLiv7b1QLCHVZWjwMpWWXzyrAPPDqSGXuwq6qhyL9f02HwiRF"
+	IV5 = "cNFG+oddxw6yiZrLviMhuBFoGLYEjqJOKjTTLUWA/RwVJNcWuWzs7mdeDUG4RKKa"
+	IV6 = "lUWjGPCx+pRFd+AcUh4sMueurX/I9iLiTnhTaoziF+4HlwiLpRK2a6VNDKqlhc59"
+	IV7 = "mXn7LV7xTvW44x6xxiJ6R7AkRLBRIkr1ozbcPeJH/7PNXk4IBUnI8WN2KpAQ1mzt"
+	IV8 = "5HPUNR9g/5XZ6zrTLvVbV2auM7TfFFvW9Qr7YgQIFaXpMd7ql2bwoeyLvchIuJum"
+)
+
+func clearCookie(w http.ResponseWriter, cookieName string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    "",
+		Expires:  time.Now().Add(-time.Hour),
+		MaxAge:   -1,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func validateCookie(cookie *http.Cookie, now time.Time) error {
+	if err := cookie.Valid(); err != nil {
+		return err
+	}
+
+	if now.After(cookie.Expires) && !cookie.Expires.IsZero() {
+		return errors.New("cookie expired")
+	}
+
+	return nil
+}
+
+func validateToken(token *jwt.Token, now time.Time) error {
+	if token == nil {
+		return fmt.Errorf("token is nil")
+	}
+
+	if !token.Valid {
+		return fmt.Errorf("token is not valid")
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("token does not contain exp claim")
+	}
+
+	if exp := time.Unix(int64(exp), 0); exp.Before(now) {
+		return fmt.Errorf("token expired at %s", exp)
+	}
+
+	return nil
+}
+
+func blake3sum(text string) (string, error) {
+	hash := blake3.New()
+	_, err := hash.WriteString(text)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// blake3Prf calculates the raw PRF output for a given challenge prefix and nonce.
+//
+// The expected prefix is 64 bytes of hex-encoded blake3 hash.
+// The nonce is a 64-bit integer (word ordering is swapped to accomodate JS number mantissa limits).
+func blake3Prf(prefix string, nonce uint64) ([]byte, error) {
+	hash := blake3.New()
+	_, err := hash.WriteString(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var nonceBytes [8]byte
+	swappedNonce := (nonce << 32) | (nonce >> 32)
+	binary.LittleEndian.PutUint64(nonceBytes[:], swappedNonce)
+	_, err = hash.Write(nonceBytes[:])
+	if err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// solutionIterations returns the minimum number of hashes a single solver thread must have computed to find the solution.
+//
+// The upper word of the solution identifies the batch of the solver thread, and the lower word is the nonce within the batch.
+func solutionIterations(solution uint64) uint64 {
+	return solution&0xffffffff + 1
+}
+
+// incPending increments the pending counter of an IP block in blocks.
+// If the counter exceeds the limit, the IP block is moved to the blocklist and true is returned.
+func incPending(c *core.Instance, blocks *core.BlockState, ipBlock ipblock.IPBlock, logger *zap.Logger) bool {
+	count := blocks.IncPending(ipBlock)
+	if count > c.MaxPending {
+		logger.Info(
+			"Max failed/active challenges reached for IP block, rejecting",
+			zap.String("ip", ipBlock.ToIPNet(c.PrefixCfg).String()),
+		)
+		blocks.InsertBlocklist(ipBlock)
+		blocks.RemovePending(ipBlock)
+		return true
+	}
+
+	return false
+}
+
+// difficultyBits returns the challenge difficulty for the client, which depends on its TLS fingerprint and bot score.
+func difficultyBits(r *http.Request, c *core.Instance) int {
+	fp := getFingerprint(r)
+	difficultyBits := c.DifficultyBitsFor(fp.JA4, fp.JA3)
+	if getAction(r) == botscore.Harder {
+		difficultyBits = min(difficultyBits+c.BotScore.HarderBits, core.MaxDifficultyBits)
+	}
+	return difficultyBits
+}
+
+// requiredDifficultyBits returns the difficulty that the client must have solved to pass.
+// Unlike difficultyBits, it includes the difficulty of a matching policy rule, which is only known to the middleware.
+func requiredDifficultyBits(r *http.Request, c *core.Instance) int {
+	if difficultyBits := getState(r).difficultyBits; difficultyBits != 0 {
+		return difficultyBits
+	}
+	return difficultyBits(r, c)
+}
+
+// puzzleDifficultyBits returns the difficulty of each sub-puzzle for the client.
+func puzzleDifficultyBits(r *http.Request, c *core.Instance) int {
+	return c.PuzzleBits(requiredDifficultyBits(r, c))
+}
+
+func challengeFor(r *http.Request, c *core.Instance) (string, error) {
+	fp := c.GetFingerprint()
+
+	payload := fmt.Sprintf("Accept-Language=%s,X-Real-IP=%s,User-Agent=%s,Fingerprint=%s,Difficulty=%d,Puzzles=%d,IV=%s",
+		r.Header.Get("Accept-Language"),
+		getClientIP(r),
+		r.Header.Get("User-Agent"),
+		fp,
+		difficultyBits(r, c),
+		c.Puzzles,
+		IV1,
+	)
+	if c.BindFingerprint {
+		payload += ",JA4=" + getFingerprint(r).JA4
+	}
+
+	return blake3sum(payload)
+}
+
+// calcSignature signs a PoW challenge. The difficulty of its sub-puzzles is signed too, as it may be raised or lowered
+// by the middleware where the endpoint can't tell.
+func calcSignature(challenge string, nonce core.Nonce, ts int64, puzzleBits int, c *core.Instance) string {
+	payload := fmt.Sprintf("Challenge=%s,Nonce=%s,TS=%d,Difficulty=%d,IV=%s", challenge, nonce, ts, puzzleBits, IV2)
+
+	signature := ed25519.Sign(c.GetPrivateKey(), []byte(payload))
+	return hex.EncodeToString(signature)
+}
+
+// newChallenge issues a new signed PoW challenge whose sub-puzzles have the given difficulty.
+func newChallenge(challenge string, puzzleBits int, c *core.Instance) web.ChallengeInput {
+	nonce := core.NewNonce()
+	ts := c.Now().Unix()
+
+	return web.ChallengeInput{
+		Challenge:  challenge,
+		Difficulty: puzzleBits,
+		Puzzles:    c.Puzzles,
+		Nonce:      nonce,
+		TS:         ts,
+		Signature:  calcSignature(challenge, nonce, ts, puzzleBits, c),
+	}
+}
+
+// calcWaitSignature signs a no-JavaScript wait ticket.
+// It uses a different IV from calcSignature so that PoW challenges and wait tickets can't be exchanged.
+func calcWaitSignature(challenge string, nonce core.Nonce, ts int64, delay time.Duration, c *core.Instance) string {
+	payload := fmt.Sprintf("Challenge=%s,Nonce=%s,TS=%d,Delay=%d,IV=%s", challenge, nonce, ts, delay, IV3)
+
+	signature := ed25519.Sign(c.GetPrivateKey(), []byte(payload))
+	return hex.EncodeToString(signature)
+}
+
+// calcCaptchaTicketSignature authenticates the nonce and timestamp of an image CAPTCHA, so that they can be checked
+// before the nonce is used up, without giving away whether an answer is right.
+func calcCaptchaTicketSignature(challenge string, nonce core.Nonce, ts int64, c *core.Instance) string {
+	payload := fmt.Sprintf("Challenge=%s,Nonce=%s,TS=%d,IV=%s", challenge, nonce, ts, IV8)
+
+	mac := hmac.New(sha256.New, c.GetPrivateKey().Seed())
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// calcCaptchaSignature authenticates the expected answer of an image CAPTCHA.
+// Unlike other signatures, it's a MAC keyed by the private key, so that clients can't check guesses offline.
+func calcCaptchaSignature(challenge string, nonce core.Nonce, ts int64, answer string, c *core.Instance) string {
+	payload := fmt.Sprintf("Challenge=%s,Nonce=%s,TS=%d,Answer=%s,IV=%s", challenge, nonce, ts, answer, IV4)
+
+	mac := hmac.New(sha256.New, c.GetPrivateKey().Seed())
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// issueApproval issues an approval for a client that passed the challenge, and sets the signed token as a cookie.
+// difficultyBits is the total difficulty of the solved PoW challenge, or zero for other kinds of challenges.
+func issueApproval(w http.ResponseWriter, r *http.Request, c *core.Instance, challenge string, response string, difficultyBits int) error {
+	approvalID := c.IssueApproval(c.AccessPerApproval)
+	now := c.Now()
+	claims := jwt.MapClaims{
+		"challenge":   challenge,
+		"response":    response,
+		"approval_id": approvalID,
+		"iat":         now.Unix(),
+		"nbf":         now.Add(-time.Minute).Unix(),
+		"exp":         now.Add(c.ApprovalTTL).Unix(),
+	}
+	if difficultyBits != 0 {
+		claims["difficulty_bits"] = difficultyBits
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	tokenStr, err := token.SignedString(c.GetPrivateKey())
+	if err != nil {
+		return fmt.Errorf("failed to sign token: %w", err)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.CookieName,
+		Value:    tokenStr,
+		Expires:  now.Add(c.ApprovalTTL),
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+
+	decPending(r, c)
+
+	return nil
+}
+
+// decPending decrements the pending counter of the IP block of the client, once its challenge is solved.
+func decPending(r *http.Request, c *core.Instance) {
+	if ipBlock, ok := getIPBlock(r); ok {
+		c.DecPending(ipBlock)
+	}
+}
+
+// hasApprovalCookie reports whether the request carries an unexpired cookie signed by this instance, even if its
+// accesses are used up or it was issued to another client.
+func hasApprovalCookie(r *http.Request, c *core.Instance) bool {
+	cookie, err := r.Cookie(c.CookieName)
+	if err != nil {
+		return false
+	}
+
+	_, err = jwt.ParseWithClaims(cookie.Value, jwt.MapClaims{}, func(_ *jwt.Token) (interface{}, error) {
+		return c.GetPublicKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}), jwt.WithExpirationRequired(), jwt.WithTimeFunc(c.Now))
+	return err == nil
+}
+
+// countsAsPending reports whether the challenge response to the request counts as pending.
+//
+// Challenge pages are pending until solved. Compact responses are only counted for clients without an approval cookie,
+// so that the subresources of a page whose approval ran out aren't counted, while clients that never passed a
+// challenge can't send non-navigation requests over and over without being blocked. Upgrade and HEAD requests are
+// never counted.
+func countsAsPending(r *http.Request, c *core.Instance) bool {
+	if isUpgrade(r) || r.Method == http.MethodHead {
+		return false
+	}
+	return isNavigation(r) || !hasApprovalCookie(r, c)
+}
+
+// checkApproval reports whether the request carries a valid cookie for this client, and redeems its approval with
+// redeem, which is c.DecApproval to consume one access.
+func checkApproval(r *http.Request, c *core.Instance, redeem func(uuid.UUID) bool, logger *zap.Logger) (bool, error) {
+	// Get the "cerberus-auth" cookie
+	cookie, err := r.Cookie(c.CookieName)
+	if err != nil {
+		logger.Debug("cookie not found", zap.Error(err))
+		return false, nil
+	}
+
+	if err := validateCookie(cookie, c.Now()); err != nil {
+		logger.Debug("invalid cookie", zap.Error(err))
+		return false, nil
+	}
+
+	token, err := jwt.ParseWithClaims(cookie.Value, jwt.MapClaims{}, func(_ *jwt.Token) (interface{}, error) {
+		return c.GetPublicKey(), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}), jwt.WithTimeFunc(c.Now))
+	if err != nil {
+		logger.Debug("invalid token", zap.Error(err))
+	}
+
+	if err := validateToken(token, c.Now()); err != nil {
+		logger.Debug("invalid token", zap.Error(err))
+		return false, nil
+	}
+
+	// Metadata structure correct. Now we need to check the approval.
+	claims := token.Claims.(jwt.MapClaims)
+
+	// A PoW challenge must have been at least as hard as the request requires, which depends on the policy.
+	// Approvals from wait tickets and CAPTCHAs don't carry a difficulty, as they aren't proofs of work. They're only
+	// accepted where neither the policy, the TLS fingerprint nor the bot score raises the difficulty.
+	required := requiredDifficultyBits(r, c)
+	if solvedBits, ok := claims["difficulty_bits"].(float64); ok && int(solvedBits) < required {
+		logger.Debug("solved challenge too easy", zap.Int("difficulty_bits", int(solvedBits)), zap.Int("required", required))
+		return false, nil
+	} else if !ok && required > c.DifficultyBits {
+		logger.Debug("challenge without proof of work not accepted", zap.Int("required", required))
+		return false, nil
+	}
+
+	// First we check approval state.
+	approvalIDRaw, ok := claims["approval_id"].(string)
+	if !ok {
+		logger.Debug("token does not contain valid approval_id claim")
+		return false, nil
+	}
+
+	approvalID, err := uuid.Parse(approvalIDRaw)
+	if err != nil {
+		logger.Debug("invalid approval_id", zap.String("approval_id", approvalIDRaw), zap.Error(err))
+		return false, nil
+	}
+
+	approved := redeem(approvalID)
+	if !approved {
+		logger.Debug("approval not found", zap.String("approval_id", approvalIDRaw))
+		return false, nil
+	}
+
+	// Then we check user fingerprint matches the challenge to prevent cookie reuse.
+	challenge, ok := claims["challenge"].(string)
+	if !ok {
+		logger.Debug("token does not contain valid challenge claim")
+		return false, nil
+	}
+
+	expected, err := challengeFor(r, c)
+	if err != nil {
+		logger.Error("failed to calculate challenge", zap.Error(err))
+		return false, err
+	}
+
+	if challenge != expected {
+		logger.Debug("challenge mismatch", zap.String("expected", expected), zap.String("actual", challenge))
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// renderChallenge counts a new pending challenge for the client and renders the challenge page.
+// After passing, the client returns to redir, or to the current page if redir is empty.
+func renderChallenge(w http.ResponseWriter, r *http.Request, c *core.Instance, baseURL string, redir string, logger *zap.Logger) error {
+	if ipBlock, ok := getIPBlock(r); ok {
+		if incPending(c, c.BlockState, ipBlock, logger) {
+			return respondFailure(w, r, &c.Config, "IP blocked", true, http.StatusForbidden, baseURL)
+		}
+	}
+
+	clearCookie(w, c.CookieName)
+
+	challenge, err := challengeFor(r, c)
+	if err != nil {
+		logger.Error("failed to calculate challenge", zap.Error(err))
+		return err
+	}
+
+	input := newChallenge(challenge, puzzleDifficultyBits(r, c), c)
+
+	// Stash non-GET requests so that the client can re-submit them after passing.
+	replay, err := stashRequest(r, challenge, c)
+	if err != nil {
+		logger.Warn("failed to stash request", zap.Error(err))
+	}
+
+	returnTo := redir
+	if returnTo == "" {
+		returnTo = originalRequestURI(r)
+	}
+
+	// Fallbacks without proof of work aren't accepted where the difficulty is raised, so they aren't offered.
+	fallbacks := requiredDifficultyBits(r, c) <= c.DifficultyBits
+
+	// Users without JavaScript may wait instead. The ticket has its own nonce so that it can't be combined with the PoW.
+	var wait *web.WaitTicket
+	if c.WaitDelay > 0 && fallbacks {
+		waitNonce := core.NewNonce()
+		wait = &web.WaitTicket{
+			Nonce:     waitNonce,
+			TS:        input.TS,
+			Signature: calcWaitSignature(challenge, waitNonce, input.TS, c.WaitDelay, c),
+			Delay:     int(math.Ceil(c.WaitDelay.Seconds())),
+			Redir:     returnTo,
+		}
+	}
+
+	// Users whose browser can't run WebAssembly may solve an image CAPTCHA instead.
+	var captchaURL string
+	if c.Captcha && fallbacks {
+		captchaURL = baseURL + "/captcha?" + url.Values{"redir": {returnTo}}.Encode()
+	}
+
+	w.Header().Set(c.HeaderName, "CHALLENGE")
+	return renderTemplate(w, r, &c.Config, baseURL, i18n.T(r.Context(), "challenge.title"), web.Challenge(input, redir, replay, wait, captchaURL), templ.WithStatus(setChallengeStatus(w, &c.Config)))
+}
+
+// originalRequestURI returns the request URI as sent by the client, before any rewrite (e.g. http.StripPrefix).
+func originalRequestURI(r *http.Request) string {
+	if r.RequestURI != "" {
+		return r.RequestURI
+	}
+	return r.URL.RequestURI()
+}
+
+// localRedirect returns redir if it's a path on the same origin, and "/" otherwise, so that the redir values of
+// challenges can't redirect clients to other sites.
+func localRedirect(redir string) string {
+	// Browsers treat backslashes like slashes, so "/\example.com" is protocol-relative as well.
+	if !strings.HasPrefix(redir, "/") || strings.HasPrefix(redir, "//") || strings.HasPrefix(redir, "/\\") {
+		return "/"
+	}
+	if u, err := url.Parse(redir); err != nil || u.Scheme != "" || u.Host != "" {
+		return "/"
+	}
+	return redir
+}
+
+// jsonResult is the response body for clients that ask for JSON instead of a page.
+type jsonResult struct {
+	// Outcome is one of "pass", "challenge", "fail" or "blocked".
+	Outcome string `json:"outcome"`
+	// Reason is the error message if the outcome is not "pass".
+	Reason string `json:"reason,omitempty"`
+	// Redirect is where the client should navigate to after passing the challenge.
+	Redirect string `json:"redirect,omitempty"`
+	// Challenge is the endpoint to fetch a challenge from if the outcome is "challenge".
+	Challenge string `json:"challenge,omitempty"`
+	// Replay is the stashed request that the client should re-submit instead of navigating to Redirect.
+	Replay *replayRequest `json:"replay,omitempty"`
+}
+
+// hasJSONBody reports whether the request body is JSON.
+func hasJSONBody(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// wantsJSON reports whether the client asked for a JSON response, either explicitly or by sending a JSON body.
+func wantsJSON(r *http.Request) bool {
+	if hasJSONBody(r) {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// isNavigation reports whether the request is a top-level navigation that can show an interactive page.
+// Requests for subresources, XHR and fetch requests and API clients get a compact response instead.
+func isNavigation(r *http.Request) bool {
+	if wantsJSON(r) {
+		return false
+	}
+
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		dest := r.Header.Get("Sec-Fetch-Dest")
+		return mode == "navigate" && (dest == "" || dest == "document" || dest == "iframe" || dest == "frame")
+	}
+
+	// Clients without Fetch Metadata get a page unless they explicitly don't accept HTML.
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(part)
+		if err == nil && (mediaType == "text/html" || mediaType == "*/*" || mediaType == "text/*") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseJSONForm parses a JSON object body into the request form, so that it can be read with FormValue.
+// Arrays become repeated fields, and strings and numbers become their text representation.
+func parseJSONForm(r *http.Request) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+
+	var body map[string]any
+	if err := decoder.Decode(&body); err != nil {
+		return err
+	}
+
+	form := make(url.Values, len(body))
+	for key, value := range body {
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		for _, value := range values {
+			switch value := value.(type) {
+			case string:
+				form.Add(key, value)
+			case json.Number:
+				form.Add(key, value.String())
+			default:
+				return fmt.Errorf("unsupported value for field %s", key)
+			}
+		}
+	}
+
+	r.Form = form
+	r.PostForm = form
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// setChallengeStatus sets the headers of a challenge response and returns its status code.
+func setChallengeStatus(w http.ResponseWriter, c *core.Config) int {
+	if c.ChallengeStatus == http.StatusTooManyRequests || c.ChallengeStatus == http.StatusServiceUnavailable {
+		// Crawlers come back after the challenge has expired.
+		w.Header().Set("Retry-After", strconv.Itoa(int(c.ChallengeTTL.Seconds())))
+	}
+	return c.ChallengeStatus
+}
+
+// respondCompact writes the result as JSON or plain text, for clients that can't show an interactive page.
+func respondCompact(w http.ResponseWriter, r *http.Request, status int, result jsonResult) error {
+	if wantsJSON(r) {
+		return writeJSON(w, status, result)
+	}
+
+	var text string
+	switch result.Outcome {
+	case "challenge":
+		text = "Cerberus challenge required. Please visit this page in a browser."
+	case "blocked":
+		text = "Access has been restricted by Cerberus."
+	default:
+		text = "Cerberus error: " + result.Reason
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.WriteHeader(status)
+	_, err := fmt.Fprintln(w, text)
+	return err
+}
+
+func respondFailure(w http.ResponseWriter, r *http.Request, c *core.Config, msg string, blocked bool, status int, baseURL string) error {
+	// Do not cache failure responses.
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if blocked {
+		if c.Drop {
+			// Drop the connection
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Set(c.HeaderName, "BLOCKED")
+		// Close the connection to the client
+		r.Close = true
+		w.Header().Set("Connection", "close")
+		if !isNavigation(r) {
+			return respondCompact(w, r, status, jsonResult{Outcome: "blocked", Reason: msg})
+		}
+		return renderTemplate(w, r, c, baseURL,
+			i18n.T(r.Context(), "error.access_restricted"),
+			web.Error(
+				i18n.T(r.Context(), "error.ip_blocked"),
+				i18n.T(r.Context(), "error.wait_before_retry"),
+				"",
+			),
+			templ.WithStatus(status),
+		)
+	}
+
+	w.Header().Set(c.HeaderName, "FAIL")
+	if !isNavigation(r) {
+		return respondCompact(w, r, status, jsonResult{Outcome: "fail", Reason: msg})
+	}
+	return renderTemplate(w, r, c, baseURL,
+		i18n.T(r.Context(), "error.error_occurred"),
+		web.Error(
+			i18n.T(r.Context(), "error.server_error"),
+			i18n.T(r.Context(), "error.browser_config_or_bug"),
+			i18n.T(r.Context(), "error.error_details", i18n.M{"error": msg}),
+		),
+		templ.WithStatus(status),
+	)
+}
+
+func setupLocale(r *http.Request) (*http.Request, error) {
+	locale := r.Header.Get("Accept-Language")
+	if locale == "" {
+		locale = "en"
+	}
+
+	ctx, err := ctxi18n.WithLocale(r.Context(), locale)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = context.WithValue(ctx, web.LocaleCtxKey, locale)
+
+	return r.WithContext(ctx), nil
+}
+
+func renderTemplate(w http.ResponseWriter, r *http.Request, c *core.Config, baseURL string, header string, child templ.Component, opts ...func(*templ.ComponentHandler)) error {
+	ctx := templ.WithChildren(
+		context.WithValue(
+			context.WithValue(
+				context.WithValue(r.Context(), web.BaseURLCtxKey, baseURL),
+				web.VersionCtxKey,
+				core.Version,
+			),
+			web.MailCtxKey,
+			c.Mail,
+		),
+		child,
+	)
+	// Neither challenges nor errors should be indexed in place of the content.
+	w.Header().Set("X-Robots-Tag", "noindex")
+	templ.Handler(
+		web.Base(c.Title, header),
+		opts...,
+	).ServeHTTP(w, r.WithContext(ctx))
+	return nil
+}
@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/internal/ipblock"
+	"go.uber.org/zap"
+)
+
+// DownloadParam is the query parameter that carries the signature of a download link.
+const DownloadParam = "cerberus-sig"
+
+// calcDownloadSignature authenticates a download link for the IP block of the client.
+// Like calcCaptchaSignature, it's a MAC keyed by the private key, as only cerberus has to verify it.
+func calcDownloadSignature(urlPath string, approvalID uuid.UUID, exp int64, ipBlock ipblock.IPBlock, c *core.Instance) string {
+	payload := fmt.Sprintf("Path=%s,Approval=%s,Exp=%d,IPBlock=%s,IV=%s", urlPath, approvalID, exp, ipBlock.ToIPNet(c.PrefixCfg), IV6)
+
+	mac := hmac.New(sha256.New, c.GetPrivateKey().Seed())
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// stripDownloadParam removes the download signature from a raw query, keeping the other parameters as they are.
+func stripDownloadParam(rawQuery string) string {
+	params := strings.Split(rawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		if param != DownloadParam && !strings.HasPrefix(param, DownloadParam+"=") {
+			kept = append(kept, param)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// signDownloadURL returns redir with a download signature if it points to a download, and redir unchanged otherwise.
+// Each signed link is an approval of its own, which allows DownloadUses requests.
+func signDownloadURL(r *http.Request, c *core.Instance, redir string) string {
+	if len(c.DownloadPatterns) == 0 {
+		return redir
+	}
+
+	u, err := url.Parse(redir)
+	if err != nil || !c.IsDownload(u.Path) {
+		return redir
+	}
+
+	ipBlock, ok := getIPBlock(r)
+	if !ok {
+		return redir
+	}
+
+	approvalID := c.IssueApproval(c.DownloadUses)
+	exp := c.Now().Add(c.DownloadTTL).Unix()
+	signature := fmt.Sprintf("%s.%d.%s", approvalID, exp, calcDownloadSignature(u.Path, approvalID, exp, ipBlock, c))
+
+	// A link that was signed for another IP block is replaced.
+	u.RawQuery = stripDownloadParam(u.RawQuery)
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += url.Values{DownloadParam: {signature}}.Encode()
+	return u.String()
+}
+
+// checkDownloadSignature reports whether the request carries a valid download signature, and redeems the approval of
+// its link with redeem, which is c.DecApproval to consume one use.
+func checkDownloadSignature(r *http.Request, c *core.Instance, redeem func(uuid.UUID) bool, logger *zap.Logger) bool {
+	if len(c.DownloadPatterns) == 0 {
+		return false
+	}
+
+	u, err := url.ParseRequestURI(originalRequestURI(r))
+	if err != nil {
+		return false
+	}
+	signature := u.Query().Get(DownloadParam)
+	if signature == "" {
+		return false
+	}
+
+	approvalIDRaw, rest, _ := strings.Cut(signature, ".")
+	expRaw, mac, _ := strings.Cut(rest, ".")
+
+	approvalID, err := uuid.Parse(approvalIDRaw)
+	if err != nil {
+		logger.Debug("invalid download approval_id", zap.String("approval_id", approvalIDRaw), zap.Error(err))
+		return false
+	}
+	exp, err := strconv.ParseInt(expRaw, 10, 64)
+	if err != nil {
+		logger.Debug("download exp is not a integer", zap.Error(err))
+		return false
+	}
+
+	ipBlock, ok := getIPBlock(r)
+	if !ok {
+		return false
+	}
+
+	expected := calcDownloadSignature(u.Path, approvalID, exp, ipBlock, c)
+	if subtle.ConstantTimeCompare([]byte(mac), []byte(expected)) != 1 {
+		logger.Debug("download signature mismatch", zap.String("path", u.Path))
+		return false
+	}
+
+	if c.Now().After(time.Unix(exp, 0).Add(c.ClockSkew)) {
+		logger.Debug("download link expired", zap.Int64("exp", exp))
+		return false
+	}
+
+	if !redeem(approvalID) {
+		logger.Debug("download link used up", zap.String("approval_id", approvalIDRaw))
+		return false
+	}
+
+	return true
+}
+
+// withoutDownloadParam returns a copy of the request without the download signature, so that it isn't passed upstream.
+func withoutDownloadParam(r *http.Request) *http.Request {
+	stripped := r.Clone(r.Context())
+	stripped.URL.RawQuery = stripDownloadParam(r.URL.RawQuery)
+	if path, query, ok := strings.Cut(r.RequestURI, "?"); ok {
+		stripped.RequestURI = path
+		if query = stripDownloadParam(query); query != "" {
+			stripped.RequestURI += "?" + query
+		}
+	}
+	return stripped
+}
@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/internal/ipblock"
+)
+
+func newDownloadInstance(t *testing.T) (*core.Instance, *testClock) {
+	t.Helper()
+
+	clock := &testClock{now: time.Unix(1_700_000_000, 0)}
+	c := newTestInstance(t, func(config *core.Config) {
+		config.DownloadPatterns = []string{"*.iso"}
+		config.DownloadUses = 2
+		config.PrefixCfg = ipblock.Config{V4Prefix: 24, V6Prefix: 64}
+		config.Clock = clock
+	})
+	return c, clock
+}
+
+// signTestDownload signs redir as if the client with the given IP passed a challenge on it.
+func signTestDownload(t *testing.T, c *core.Instance, redir string, ip string) string {
+	t.Helper()
+
+	r, err := setupRequest(newTestRequest(http.MethodPost, "/answer", ip), c, RemoteAddrIP, nil)
+	if err != nil {
+		t.Fatalf("failed to set up request: %v", err)
+	}
+	return signDownloadURL(r, c, redir)
+}
+
+func TestSignDownloadURL(t *testing.T) {
+	c, _ := newDownloadInstance(t)
+
+	if signed := signTestDownload(t, c, "/index.html", "192.0.2.1"); signed != "/index.html" {
+		t.Errorf("expected other files not to be signed, got %s", signed)
+	}
+
+	signed := signTestDownload(t, c, "/files/a.iso?mirror=1&"+DownloadParam+"=stale", "192.0.2.1")
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("invalid signed URL %s: %v", signed, err)
+	}
+	if u.Path != "/files/a.iso" || u.Query().Get("mirror") != "1" {
+		t.Errorf("expected the link to keep its path and query, got %s", signed)
+	}
+	if values := u.Query()[DownloadParam]; len(values) != 1 || values[0] == "stale" {
+		t.Errorf("expected a single new signature, got %v", values)
+	}
+}
+
+func TestCheckDownloadSignature(t *testing.T) {
+	c, clock := newDownloadInstance(t)
+	m := NewMiddleware(c, "/.cerberus")
+
+	signed := signTestDownload(t, c, "/files/a.iso?mirror=1", "192.0.2.1")
+	u, _ := url.Parse(signed)
+	signature := u.Query().Get(DownloadParam)
+	approvalID, rest, _ := strings.Cut(signature, ".")
+	exp, mac, _ := strings.Cut(rest, ".")
+
+	withSignature := func(path string, signature string) string {
+		return path + "?mirror=1&" + url.Values{DownloadParam: {signature}}.Encode()
+	}
+	expInt, _ := strconv.ParseInt(exp, 10, 64)
+
+	rejected := []struct {
+		name   string
+		target string
+		ip     string
+	}{
+		{name: "other path", target: withSignature("/files/b.iso", signature), ip: "192.0.2.1"},
+		{name: "other approval", target: withSignature("/files/a.iso", uuid.New().String()+"."+exp+"."+mac), ip: "192.0.2.1"},
+		{name: "extended expiry", target: withSignature("/files/a.iso", approvalID+"."+strconv.FormatInt(expInt+3600, 10)+"."+mac), ip: "192.0.2.1"},
+		{name: "other IP block", target: signed, ip: "198.51.100.1"},
+		{name: "malformed", target: withSignature("/files/a.iso", "garbage"), ip: "192.0.2.1"},
+	}
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			w, passed := serve(t, m, newTestRequest(http.MethodGet, tt.target, tt.ip))
+			if passed != nil || w.Header().Get(c.HeaderName) != "CHALLENGE" {
+				t.Errorf("expected the link to be rejected, got status %q", w.Header().Get(c.HeaderName))
+			}
+		})
+	}
+
+	t.Run("uses", func(t *testing.T) {
+		// Any IP of the same block may use the link, as often as DownloadUses allows.
+		for _, ip := range []string{"192.0.2.1", "192.0.2.77"} {
+			w, passed := serve(t, m, newTestRequest(http.MethodGet, signed, ip))
+			if passed == nil || w.Header().Get(c.HeaderName) != "PASS" {
+				t.Fatalf("%s: expected the link to pass, got status %q", ip, w.Header().Get(c.HeaderName))
+			}
+			// The signature isn't passed to the backend, but the rest of the query is.
+			if passed.URL.Query().Has(DownloadParam) || strings.Contains(passed.RequestURI, DownloadParam) {
+				t.Errorf("expected the signature to be removed, got %s", passed.RequestURI)
+			}
+			if passed.URL.RawQuery != "mirror=1" || passed.RequestURI != "/files/a.iso?mirror=1" {
+				t.Errorf("expected the rest of the query to be kept, got %s", passed.RequestURI)
+			}
+		}
+
+		w, passed := serve(t, m, newTestRequest(http.MethodGet, signed, "192.0.2.1"))
+		if passed != nil || w.Header().Get(c.HeaderName) != "CHALLENGE" {
+			t.Errorf("expected the link to be used up, got status %q", w.Header().Get(c.HeaderName))
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		signed := signTestDownload(t, c, "/files/a.iso", "192.0.2.1")
+		clock.now = clock.now.Add(c.DownloadTTL + c.ClockSkew + time.Second)
+
+		w, passed := serve(t, m, newTestRequest(http.MethodGet, signed, "192.0.2.1"))
+		if passed != nil || w.Header().Get(c.HeaderName) != "CHALLENGE" {
+			t.Errorf("expected the link to be expired, got status %q", w.Header().Get(c.HeaderName))
+		}
+	})
+}
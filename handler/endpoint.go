@@ -0,0 +1,620 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/png"
+	"math/bits"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/a-h/templ"
+	"github.com/invopop/ctxi18n/i18n"
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/internal/captcha"
+	"github.com/sjtug/cerberus/web"
+	"go.uber.org/zap"
+)
+
+const (
+	captchaLength = 6
+	// maxAnswerBodySize is the size limit of a JSON answer body.
+	maxAnswerBodySize = 64 << 10
+)
+
+// Endpoint serves challenge endpoints and static files. It expects paths without the base URL of the middleware.
+type Endpoint struct {
+	// ClientIP returns the IP of the client. Defaults to RemoteAddrIP.
+	ClientIP ClientIPFunc
+	// TLSFingerprint returns the TLS fingerprint of the client. Fingerprint rules don't apply if it's nil.
+	TLSFingerprint TLSFingerprintFunc
+	// Logger defaults to a no-op logger.
+	Logger *zap.Logger
+
+	instance *core.Instance
+}
+
+// NewEndpoint creates an endpoint with the given cerberus instance.
+func NewEndpoint(instance *core.Instance) *Endpoint {
+	return &Endpoint{
+		ClientIP: RemoteAddrIP,
+		Logger:   zap.NewNop(),
+		instance: instance,
+	}
+}
+
+// checkAnswer reports whether the hash has at least the given number of leading zero bits.
+func checkAnswer(hash []byte, difficultyBits int) bool {
+	for _, b := range hash {
+		if difficultyBits <= 0 {
+			return true
+		}
+		if difficultyBits < 8 {
+			return bits.LeadingZeros8(b) >= difficultyBits
+		}
+		if b != 0 {
+			return false
+		}
+		difficultyBits -= 8
+	}
+
+	return difficultyBits <= 0
+}
+
+// answerRejection is the reason why an answer was rejected, to be reported to the client.
+type answerRejection struct {
+	msg    string
+	status int
+	// blocked is true if the IP block of the client has been blocked.
+	blocked bool
+	// clearCookie is true if the answer was invalid, rather than malformed or stale.
+	clearCookie bool
+}
+
+func (r *answerRejection) Error() string {
+	return r.msg
+}
+
+// verifyAnswer verifies the PoW answer in the request, and returns the challenge, the responses of the sub-puzzles and
+// the total difficulty of the challenge. The returned error is an *answerRejection if the answer was rejected.
+func (e *Endpoint) verifyAnswer(w http.ResponseWriter, r *http.Request) (string, []string, int, error) {
+	c := e.instance
+
+	// The answer may also be submitted as a JSON object with the same fields as the form.
+	if hasJSONBody(r) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxAnswerBodySize)
+		if err := parseJSONForm(r); err != nil {
+			e.Logger.Debug("malformed JSON body", zap.Error(err))
+			return "", nil, 0, &answerRejection{msg: "malformed JSON body", status: http.StatusBadRequest}
+		}
+	}
+
+	nonceStr := r.FormValue("nonce")
+	if nonceStr == "" {
+		e.Logger.Info("nonce is empty")
+		return "", nil, 0, &answerRejection{msg: "nonce is empty", status: http.StatusBadRequest}
+	}
+	nonce, err := core.ParseNonce(nonceStr)
+	if err != nil {
+		e.Logger.Debug("invalid nonce", zap.Error(err))
+		return "", nil, 0, &answerRejection{msg: "invalid nonce", status: http.StatusBadRequest}
+	}
+
+	tsStr := r.FormValue("ts")
+	if tsStr == "" {
+		e.Logger.Info("ts is empty")
+		return "", nil, 0, &answerRejection{msg: "ts is empty", status: http.StatusBadRequest}
+	}
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		e.Logger.Debug("ts is not a integer", zap.Error(err))
+		return "", nil, 0, &answerRejection{msg: "ts is not a integer", status: http.StatusBadRequest}
+	}
+	if !c.InWindow(time.Unix(ts, 0), c.ChallengeTTL) {
+		e.Logger.Info("invalid ts", zap.Int64("ts", ts), zap.Int64("now", c.Now().Unix()))
+		return "", nil, 0, &answerRejection{msg: "invalid ts", status: http.StatusBadRequest}
+	}
+
+	signature := r.FormValue("signature")
+	if signature == "" {
+		e.Logger.Info("signature is empty")
+		return "", nil, 0, &answerRejection{msg: "signature is empty", status: http.StatusBadRequest}
+	}
+
+	// The difficulty is signed along with the challenge. Clients that don't send it solved the usual difficulty.
+	difficultyBits := puzzleDifficultyBits(r, c)
+	if difficultyStr := r.FormValue("difficulty"); difficultyStr != "" {
+		difficultyBits, err = strconv.Atoi(difficultyStr)
+		if err != nil {
+			e.Logger.Debug("difficulty is not a integer", zap.Error(err))
+			return "", nil, 0, &answerRejection{msg: "difficulty is not a integer", status: http.StatusBadRequest}
+		}
+	}
+
+	// The form is already parsed by FormValue. There's one solution and response per sub-puzzle.
+	solutionStrs := r.Form["solution"]
+	if len(solutionStrs) == 0 {
+		e.Logger.Info("solution is empty")
+		return "", nil, 0, &answerRejection{msg: "solution is empty", status: http.StatusBadRequest}
+	}
+	responses := r.Form["response"]
+	if len(solutionStrs) != c.Puzzles || len(responses) != c.Puzzles {
+		e.Logger.Info("wrong number of solutions",
+			zap.Int("solutions", len(solutionStrs)), zap.Int("responses", len(responses)), zap.Int("puzzles", c.Puzzles))
+		return "", nil, 0, &answerRejection{msg: "wrong number of solutions", status: http.StatusBadRequest}
+	}
+	solutions := make([]uint64, len(solutionStrs))
+	for i, solutionStr := range solutionStrs {
+		solutions[i], err = strconv.ParseUint(solutionStr, 10, 64)
+		if err != nil {
+			e.Logger.Debug("solution is not a integer", zap.Error(err))
+			return "", nil, 0, &answerRejection{msg: "solution is not a integer", status: http.StatusBadRequest}
+		}
+	}
+
+	challenge, err := challengeFor(r, c)
+	if err != nil {
+		e.Logger.Error("failed to calculate challenge", zap.Error(err))
+		return "", nil, 0, err
+	}
+
+	expectedSignature := calcSignature(challenge, nonce, ts, difficultyBits, c)
+	if signature != expectedSignature {
+		e.Logger.Debug("signature mismatch", zap.String("expected", expectedSignature), zap.String("actual", signature))
+		return "", nil, 0, &answerRejection{msg: "signature mismatch", status: http.StatusForbidden}
+	}
+
+	// Only consume the nonce for well-formed answers, so that a stale challenge can still be refreshed.
+	if !c.InsertUsedNonce(nonce) {
+		e.Logger.Info("nonce already used")
+		return "", nil, 0, &answerRejection{msg: "nonce already used", status: http.StatusBadRequest}
+	}
+
+	// Every sub-puzzle must be solved, each with its own salt.
+	for i, solution := range solutions {
+		response := responses[i]
+
+		saltStr, err := blake3sum(fmt.Sprintf("%s|%s|%d|%s|%d|", challenge, nonce, ts, signature, i))
+		if err != nil {
+			e.Logger.Error("failed to calculate salt", zap.Error(err))
+			return "", nil, 0, err
+		}
+
+		answer, err := blake3Prf(saltStr, solution)
+		if err != nil {
+			e.Logger.Error("failed to calculate answer", zap.Error(err))
+			return "", nil, 0, err
+		}
+
+		if !checkAnswer(answer, difficultyBits) {
+			e.Logger.Error("wrong response", zap.Int("puzzle", i), zap.String("response", response), zap.Int("difficulty_bits", difficultyBits))
+			return "", nil, 0, &answerRejection{msg: "wrong response", status: http.StatusForbidden, clearCookie: true}
+		}
+
+		answerStr := hex.EncodeToString(answer)
+		if subtle.ConstantTimeCompare([]byte(answerStr), []byte(response)) != 1 {
+			e.Logger.Error("response mismatch", zap.Int("puzzle", i), zap.String("expected", answerStr), zap.String("actual", response))
+			return "", nil, 0, &answerRejection{msg: "response mismatch", status: http.StatusForbidden, clearCookie: true}
+		}
+	}
+
+	// Reject answers computed faster than any browser could, which points at outsourced solving.
+	var iterations uint64
+	for _, solution := range solutions {
+		iterations += solutionIterations(solution)
+	}
+	elapsed := c.Now().Sub(time.Unix(ts, 0))
+	if minSolveTime := c.MinSolveTime(iterations); elapsed < minSolveTime {
+		e.Logger.Info("implausibly fast solution",
+			zap.Uint64("iterations", iterations), zap.Duration("elapsed", elapsed), zap.Duration("min_solve_time", minSolveTime))
+
+		if ipBlock, ok := getIPBlock(r); ok {
+			if incPending(c, c.BlockState, ipBlock, e.Logger) {
+				return "", nil, 0, &answerRejection{msg: "IP blocked", status: http.StatusForbidden, blocked: true, clearCookie: true}
+			}
+		}
+		return "", nil, 0, &answerRejection{msg: "solved too fast", status: http.StatusForbidden, clearCookie: true}
+	}
+
+	recordTelemetry(r, c.Puzzles, iterations, elapsed, e.Logger)
+
+	return challenge, responses, c.TotalBits(difficultyBits), nil
+}
+
+func (e *Endpoint) answerHandle(w http.ResponseWriter, r *http.Request) error {
+	c := e.instance
+
+	// Just to make sure the response is not cached, although this should be the default behavior for POST requests.
+	w.Header().Set("Cache-Control", "no-cache")
+
+	challenge, responses, difficultyBits, err := e.verifyAnswer(w, r)
+	var rejection *answerRejection
+	if errors.As(err, &rejection) {
+		if rejection.clearCookie {
+			clearCookie(w, c.CookieName)
+		}
+		return respondFailure(w, r, &c.Config, rejection.msg, rejection.blocked, rejection.status, ".")
+	}
+	if err != nil {
+		return err
+	}
+
+	// Now we know the user passed the challenge, we issue an approval and sign the result.
+	if err := issueApproval(w, r, c, challenge, strings.Join(responses, ","), difficultyBits); err != nil {
+		e.Logger.Error("failed to issue approval", zap.Error(err))
+		return err
+	}
+
+	e.Logger.Debug("user passed the challenge")
+
+	// Downloads get a signed link, which can be copied to clients that don't have the cookie.
+	redir := signDownloadURL(r, c, localRedirect(r.FormValue("redir")))
+
+	w.Header().Set(c.HeaderName, "PASS")
+	if wantsJSON(r) {
+		// Let the client decide how to navigate, or re-submit the request that was interrupted by the challenge.
+		result := jsonResult{Outcome: "pass", Redirect: redir}
+		if sealed := r.FormValue("replay"); sealed != "" {
+			replay, err := openReplay(sealed, challenge, c)
+			if err != nil {
+				e.Logger.Debug("invalid stashed request", zap.Error(err))
+			} else {
+				result.Replay = replay
+			}
+		}
+		return writeJSON(w, http.StatusOK, result)
+	}
+	http.Redirect(w, r, redir, http.StatusSeeOther)
+	return nil
+}
+
+// challengeHandle issues a new PoW challenge as JSON, so that the challenge page can retry without reloading.
+//
+// If the client supplies a previous challenge that hasn't been answered, it's swapped for a new one of the same
+// difficulty and the pending counter is left untouched. Otherwise the new challenge counts as pending like a challenge
+// page, and the client may ask for a harder challenge than usual, as the middleware does when a policy requires it.
+func (e *Endpoint) challengeHandle(w http.ResponseWriter, r *http.Request) error {
+	c := e.instance
+
+	w.Header().Set("Cache-Control", "no-cache")
+
+	challenge, err := challengeFor(r, c)
+	if err != nil {
+		e.Logger.Error("failed to calculate challenge", zap.Error(err))
+		return err
+	}
+
+	difficultyBits, swapped := e.swapChallenge(r, challenge)
+	if !swapped {
+		if ipBlock, ok := getIPBlock(r); ok {
+			if incPending(c, c.BlockState, ipBlock, e.Logger) {
+				return respondFailure(w, r, &c.Config, "IP blocked", true, http.StatusForbidden, ".")
+			}
+		}
+
+		difficultyBits = puzzleDifficultyBits(r, c)
+		if requested, err := strconv.Atoi(r.URL.Query().Get("difficulty")); err == nil {
+			difficultyBits = min(max(difficultyBits, requested), c.PuzzleBits(core.MaxDifficultyBits))
+		}
+	}
+
+	w.Header().Set(c.HeaderName, "CHALLENGE")
+	return writeJSON(w, http.StatusOK, newChallenge(challenge, difficultyBits, c))
+}
+
+// swapChallenge consumes the previous challenge given in the query, and reports whether it was valid, recent and unused.
+// It returns the difficulty of the sub-puzzles of the previous challenge.
+func (e *Endpoint) swapChallenge(r *http.Request, challenge string) (int, bool) {
+	c := e.instance
+
+	query := r.URL.Query()
+	if !query.Has("nonce") {
+		return 0, false
+	}
+	nonce, err := core.ParseNonce(query.Get("nonce"))
+	if err != nil {
+		e.Logger.Debug("invalid nonce", zap.Error(err))
+		return 0, false
+	}
+	ts, err := strconv.ParseInt(query.Get("ts"), 10, 64)
+	if err != nil {
+		e.Logger.Debug("ts is not a integer", zap.Error(err))
+		return 0, false
+	}
+	// Challenges that expired while being solved, e.g. on slow devices, may be swapped within one more lifetime.
+	// Older ones are treated like new ones, since their nonces may have been forgotten by then.
+	if !c.InWindow(time.Unix(ts, 0), 2*c.ChallengeTTL) {
+		e.Logger.Debug("previous challenge expired", zap.Int64("ts", ts), zap.Int64("now", c.Now().Unix()))
+		return 0, false
+	}
+	difficultyBits := puzzleDifficultyBits(r, c)
+	if query.Has("difficulty") {
+		difficultyBits, err = strconv.Atoi(query.Get("difficulty"))
+		if err != nil {
+			e.Logger.Debug("difficulty is not a integer", zap.Error(err))
+			return 0, false
+		}
+	}
+
+	expectedSignature := calcSignature(challenge, nonce, ts, difficultyBits, c)
+	if subtle.ConstantTimeCompare([]byte(query.Get("signature")), []byte(expectedSignature)) != 1 {
+		e.Logger.Debug("signature mismatch", zap.String("expected", expectedSignature), zap.String("actual", query.Get("signature")))
+		return 0, false
+	}
+
+	if !c.InsertUsedNonce(nonce) {
+		e.Logger.Debug("previous challenge already used")
+		return 0, false
+	}
+
+	return difficultyBits, true
+}
+
+// waitHandle redeems a no-JavaScript wait ticket once its delay has passed.
+func (e *Endpoint) waitHandle(w http.ResponseWriter, r *http.Request) error {
+	c := e.instance
+
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if c.WaitDelay == 0 {
+		e.Logger.Info("wait tickets are disabled")
+		return respondFailure(w, r, &c.Config, "wait tickets are disabled", false, http.StatusNotFound, ".")
+	}
+
+	nonce, err := core.ParseNonce(r.FormValue("nonce"))
+	if err != nil {
+		e.Logger.Debug("invalid nonce", zap.Error(err))
+		return respondFailure(w, r, &c.Config, "invalid nonce", false, http.StatusBadRequest, ".")
+	}
+
+	ts, err := strconv.ParseInt(r.FormValue("ts"), 10, 64)
+	if err != nil {
+		e.Logger.Debug("ts is not a integer", zap.Error(err))
+		return respondFailure(w, r, &c.Config, "ts is not a integer", false, http.StatusBadRequest, ".")
+	}
+
+	signature := r.FormValue("signature")
+	redir := localRedirect(r.FormValue("redir"))
+
+	challenge, err := challengeFor(r, c)
+	if err != nil {
+		e.Logger.Error("failed to calculate challenge", zap.Error(err))
+		return err
+	}
+
+	expectedSignature := calcWaitSignature(challenge, nonce, ts, c.WaitDelay, c)
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(expectedSignature)) != 1 {
+		e.Logger.Debug("signature mismatch", zap.String("expected", expectedSignature), zap.String("actual", signature))
+		return respondFailure(w, r, &c.Config, "signature mismatch", false, http.StatusForbidden, ".")
+	}
+
+	// The ticket is redeemable after the delay, and only for a limited time.
+	// Clock skew is only tolerated for expiry, as it would shorten the delay otherwise.
+	now := c.Now()
+	redeemableAt := time.Unix(ts, 0).Add(c.WaitDelay)
+	if now.Before(redeemableAt) {
+		e.Logger.Info("wait ticket redeemed too early", zap.Duration("remaining", redeemableAt.Sub(now)))
+		return respondFailure(w, r, &c.Config, "ticket is not redeemable yet", false, http.StatusForbidden, ".")
+	}
+	if !c.InWindow(redeemableAt, c.ChallengeTTL) {
+		e.Logger.Info("wait ticket expired", zap.Int64("ts", ts))
+		return respondFailure(w, r, &c.Config, "ticket expired", false, http.StatusForbidden, ".")
+	}
+
+	if !c.InsertUsedNonce(nonce) {
+		e.Logger.Info("nonce already used")
+		return respondFailure(w, r, &c.Config, "nonce already used", false, http.StatusBadRequest, ".")
+	}
+
+	if err := issueApproval(w, r, c, challenge, "wait", 0); err != nil {
+		e.Logger.Error("failed to issue approval", zap.Error(err))
+		return err
+	}
+
+	e.Logger.Debug("user redeemed a wait ticket")
+
+	w.Header().Set(c.HeaderName, "PASS")
+	http.Redirect(w, r, signDownloadURL(r, c, redir), http.StatusSeeOther)
+	return nil
+}
+
+// captchaPage renders a new image CAPTCHA.
+// It isn't counted as pending, since the challenge page that links to it already is.
+func (e *Endpoint) captchaPage(w http.ResponseWriter, r *http.Request, redir string, message string) error {
+	c := e.instance
+
+	challenge, err := challengeFor(r, c)
+	if err != nil {
+		e.Logger.Error("failed to calculate challenge", zap.Error(err))
+		return err
+	}
+
+	answer, img := captcha.Generate(captchaLength)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		e.Logger.Error("failed to encode captcha", zap.Error(err))
+		return err
+	}
+
+	nonce := core.NewNonce()
+	ts := c.Now().Unix()
+	signature := calcCaptchaTicketSignature(challenge, nonce, ts, c)
+	answerSignature := calcCaptchaSignature(challenge, nonce, ts, answer, c)
+	image := "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	w.Header().Set(c.HeaderName, "CHALLENGE")
+	return renderTemplate(w, r, &c.Config, ".", i18n.T(r.Context(), "captcha.title"), web.Captcha(image, nonce, ts, signature, answerSignature, redir, message), templ.WithStatus(setChallengeStatus(w, &c.Config)))
+}
+
+// captchaHandle serves and verifies image CAPTCHAs, the fallback for browsers without WebAssembly.
+func (e *Endpoint) captchaHandle(w http.ResponseWriter, r *http.Request) error {
+	c := e.instance
+
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if !c.Captcha {
+		e.Logger.Info("captcha is disabled")
+		return respondFailure(w, r, &c.Config, "captcha is disabled", false, http.StatusNotFound, ".")
+	}
+
+	redir := localRedirect(r.FormValue("redir"))
+	if r.Method == http.MethodGet {
+		return e.captchaPage(w, r, redir, "")
+	}
+
+	nonce, err := core.ParseNonce(r.FormValue("nonce"))
+	if err != nil {
+		e.Logger.Debug("invalid nonce", zap.Error(err))
+		return respondFailure(w, r, &c.Config, "invalid nonce", false, http.StatusBadRequest, ".")
+	}
+
+	ts, err := strconv.ParseInt(r.FormValue("ts"), 10, 64)
+	if err != nil {
+		e.Logger.Debug("ts is not a integer", zap.Error(err))
+		return respondFailure(w, r, &c.Config, "ts is not a integer", false, http.StatusBadRequest, ".")
+	}
+
+	challenge, err := challengeFor(r, c)
+	if err != nil {
+		e.Logger.Error("failed to calculate challenge", zap.Error(err))
+		return err
+	}
+
+	// Check the ticket before using up the nonce, so that forged nonces don't fill the used nonce filter.
+	signature := r.FormValue("signature")
+	expectedSignature := calcCaptchaTicketSignature(challenge, nonce, ts, c)
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(expectedSignature)) != 1 {
+		e.Logger.Debug("signature mismatch", zap.String("expected", expectedSignature), zap.String("actual", signature))
+		return respondFailure(w, r, &c.Config, "signature mismatch", false, http.StatusForbidden, ".")
+	}
+
+	if !c.InWindow(time.Unix(ts, 0), c.ChallengeTTL) {
+		e.Logger.Info("invalid ts", zap.Int64("ts", ts), zap.Int64("now", c.Now().Unix()))
+		return e.captchaPage(w, r, redir, i18n.T(r.Context(), "captcha.expired"))
+	}
+
+	// Each CAPTCHA takes a single guess, so that the answer can't be brute forced.
+	if !c.InsertUsedNonce(nonce) {
+		e.Logger.Info("nonce already used")
+		return respondFailure(w, r, &c.Config, "nonce already used", false, http.StatusBadRequest, ".")
+	}
+
+	answer := strings.ToUpper(strings.TrimSpace(r.FormValue("answer")))
+	expectedAnswerSignature := calcCaptchaSignature(challenge, nonce, ts, answer, c)
+	if subtle.ConstantTimeCompare([]byte(r.FormValue("answer_signature")), []byte(expectedAnswerSignature)) != 1 {
+		e.Logger.Info("wrong captcha answer")
+
+		// Wrong answers count as failed requests, so that clients guessing answers are blocked.
+		if ipBlock, ok := getIPBlock(r); ok {
+			if incPending(c, c.BlockState, ipBlock, e.Logger) {
+				return respondFailure(w, r, &c.Config, "IP blocked", true, http.StatusForbidden, ".")
+			}
+		}
+		return e.captchaPage(w, r, redir, i18n.T(r.Context(), "captcha.wrong_answer"))
+	}
+
+	if err := issueApproval(w, r, c, challenge, "captcha", 0); err != nil {
+		e.Logger.Error("failed to issue approval", zap.Error(err))
+		return err
+	}
+
+	e.Logger.Debug("user passed the captcha")
+
+	w.Header().Set(c.HeaderName, "PASS")
+	http.Redirect(w, r, signDownloadURL(r, c, redir), http.StatusSeeOther)
+	return nil
+}
+
+// tryServeFile serves static files from the dist directory.
+func tryServeFile(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, "/static/") {
+		return false
+	}
+
+	// Remove the /static/ prefix to get the actual file path
+	filePath := path.Join("/dist", path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/static/")))
+
+	// Add cache control headers for static assets
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable") // Cache for 1 year
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	// Create a new request with the modified path
+	req := *r
+	req.URL.Path = filePath
+
+	// Serve the file using http.FileServer
+	http.FileServer(http.FS(web.Content)).ServeHTTP(w, &req)
+	return true
+}
+
+func (e *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := e.Serve(w, r); err != nil {
+		e.Logger.Error("failed to handle request", zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// Serve serves a challenge endpoint or a static file.
+func (e *Endpoint) Serve(w http.ResponseWriter, r *http.Request) error {
+	c := e.instance
+
+	r, err := setupRequest(r, c, e.ClientIP, e.TLSFingerprint)
+	if err != nil {
+		return err
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
+	if isBlocked(r, c, c.BlockState, e.Logger) {
+		if path == "/auth" {
+			// The connection belongs to the frontend proxy, which would report an error if it's dropped.
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set(c.HeaderName, "BLOCKED")
+			return respondCompact(w, r, http.StatusForbidden, jsonResult{Outcome: "blocked"})
+		}
+		return respondFailure(w, r, &c.Config, "", true, http.StatusForbidden, ".")
+	}
+
+	if tryServeFile(w, r) {
+		return nil
+	}
+
+	if path == "/answer" && r.Method == http.MethodPost {
+		return e.answerHandle(w, r)
+	}
+	if path == "/challenge" && r.Method == http.MethodGet {
+		return e.challengeHandle(w, r)
+	}
+	if path == "/token" && r.Method == http.MethodPost {
+		return e.tokenHandle(w, r)
+	}
+	if path == "/siteverify" && r.Method == http.MethodPost {
+		return e.siteverifyHandle(w, r)
+	}
+	if path == "/widget.js" && r.Method == http.MethodGet {
+		return e.widgetScriptHandle(w, r)
+	}
+	if path == "/auth" {
+		return e.forwardAuthHandle(w, r)
+	}
+	if path == "/challenge-page" && r.Method == http.MethodGet {
+		return e.challengePageHandle(w, r)
+	}
+	if path == "/wait" && (r.Method == http.MethodGet || r.Method == http.MethodPost) {
+		return e.waitHandle(w, r)
+	}
+	if path == "/captcha" && (r.Method == http.MethodGet || r.Method == http.MethodPost) {
+		return e.captchaHandle(w, r)
+	}
+
+	return respondFailure(w, r, &c.Config, "Not found", false, http.StatusNotFound, ".")
+}
+
+var _ http.Handler = (*Endpoint)(nil)
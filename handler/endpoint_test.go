@@ -0,0 +1,527 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/internal/ipblock"
+)
+
+// testChallengeInput is web.ChallengeInput as sent to the challenge page.
+type testChallengeInput struct {
+	Challenge  string `json:"challenge"`
+	Difficulty int    `json:"difficulty"`
+	Nonce      string `json:"nonce"`
+	TS         int64  `json:"ts"`
+	Signature  string `json:"signature"`
+}
+
+// fetchChallenge requests a challenge from the endpoint, swapping the previous one if given.
+func fetchChallenge(t *testing.T, e *Endpoint, previous *testChallengeInput) testChallengeInput {
+	t.Helper()
+
+	target := "/challenge"
+	if previous != nil {
+		target += "?" + url.Values{
+			"nonce":      {previous.Nonce},
+			"ts":         {strconv.FormatInt(previous.TS, 10)},
+			"signature":  {previous.Signature},
+			"difficulty": {strconv.Itoa(previous.Difficulty)},
+		}.Encode()
+	}
+	r := newTestRequest(http.MethodGet, target, "192.0.2.1")
+	r.Header.Set("Accept", "application/json")
+
+	w := httptest.NewRecorder()
+	if err := e.Serve(w, r); err != nil {
+		t.Fatalf("failed to serve request: %v", err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	var input testChallengeInput
+	if err := json.Unmarshal(w.Body.Bytes(), &input); err != nil {
+		t.Fatalf("failed to decode challenge: %v", err)
+	}
+	return input
+}
+
+// testHash returns a 32-byte hash starting with the given bytes, followed by 0xff.
+func testHash(prefix ...byte) []byte {
+	hash := bytes.Repeat([]byte{0xff}, 32)
+	copy(hash, prefix)
+	return hash
+}
+
+func TestCheckAnswer(t *testing.T) {
+	tests := []struct {
+		name     string
+		hash     []byte
+		bits     int
+		expected bool
+	}{
+		{name: "no zeros for 0 bits", hash: testHash(), bits: 0, expected: true},
+		{name: "no zeros for 7 bits", hash: testHash(), bits: 7, expected: false},
+		{name: "7 zeros for 7 bits", hash: testHash(0x01), bits: 7, expected: true},
+		{name: "6 zeros for 7 bits", hash: testHash(0x03), bits: 7, expected: false},
+		{name: "7 zeros for 8 bits", hash: testHash(0x01), bits: 8, expected: false},
+		{name: "8 zeros for 8 bits", hash: testHash(0x00, 0x80), bits: 8, expected: true},
+		{name: "8 zeros for 9 bits", hash: testHash(0x00, 0x80), bits: 9, expected: false},
+		{name: "9 zeros for 9 bits", hash: testHash(0x00, 0x40), bits: 9, expected: true},
+		{name: "9 zeros for 16 bits", hash: testHash(0x00, 0x40), bits: 16, expected: false},
+		{name: "15 zeros for 16 bits", hash: testHash(0x00, 0x01), bits: 16, expected: false},
+		{name: "16 zeros for 16 bits", hash: testHash(0x00, 0x00, 0x80), bits: 16, expected: true},
+		{name: "more zeros than required", hash: testHash(0x00, 0x00, 0x00), bits: 9, expected: true},
+		{name: "hash shorter than difficulty", hash: []byte{0x00}, bits: 9, expected: false},
+	}
+
+	for _, tt := range tests {
+		if got := checkAnswer(tt.hash, tt.bits); got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestSwapChallenge(t *testing.T) {
+	clock := &testClock{now: time.Unix(1_700_000_000, 0)}
+	c := newTestInstance(t, func(config *core.Config) {
+		config.Clock = clock
+	})
+	e := NewEndpoint(c)
+
+	ipBlock, err := ipblock.NewIPBlock([]byte{192, 0, 2, 1}, c.PrefixCfg)
+	if err != nil {
+		t.Fatalf("failed to create IP block: %v", err)
+	}
+
+	first := fetchChallenge(t, e, nil)
+	if pending := c.GetPending(ipBlock); pending != 1 {
+		t.Fatalf("expected a new challenge to be pending, got %d", pending)
+	}
+
+	second := fetchChallenge(t, e, &first)
+	if pending := c.GetPending(ipBlock); pending != 1 {
+		t.Errorf("expected a swapped challenge not to be counted, got %d pending", pending)
+	}
+	if second.Nonce == first.Nonce || second.Difficulty != first.Difficulty {
+		t.Errorf("expected a new challenge of the same difficulty, got %+v after %+v", second, first)
+	}
+
+	fetchChallenge(t, e, &first)
+	if pending := c.GetPending(ipBlock); pending != 2 {
+		t.Errorf("expected a used challenge not to be swapped, got %d pending", pending)
+	}
+
+	// A challenge that has just expired, e.g. on a slow phone, is swapped without counting again.
+	clock.now = clock.now.Add(c.ChallengeTTL + c.ClockSkew + time.Second)
+	third := fetchChallenge(t, e, &second)
+	if pending := c.GetPending(ipBlock); pending != 2 {
+		t.Errorf("expected a just expired challenge to be swapped, got %d pending", pending)
+	}
+
+	clock.now = clock.now.Add(2*c.ChallengeTTL + c.ClockSkew + time.Second)
+	fetchChallenge(t, e, &third)
+	if pending := c.GetPending(ipBlock); pending != 3 {
+		t.Errorf("expected a long expired challenge not to be swapped, got %d pending", pending)
+	}
+}
+
+func TestLocalRedirect(t *testing.T) {
+	tests := []struct {
+		redir    string
+		expected string
+	}{
+		{redir: "/", expected: "/"},
+		{redir: "/page?x=1#top", expected: "/page?x=1#top"},
+		{redir: "", expected: "/"},
+		{redir: "page", expected: "/"},
+		{redir: "https://example.com/", expected: "/"},
+		{redir: "//example.com/", expected: "/"},
+		{redir: "/\\example.com/", expected: "/"},
+		{redir: "/\t/example.com/", expected: "/"},
+		{redir: "javascript:alert(1)", expected: "/"},
+	}
+
+	for _, tt := range tests {
+		if got := localRedirect(tt.redir); got != tt.expected {
+			t.Errorf("localRedirect(%q): expected %q, got %q", tt.redir, tt.expected, got)
+		}
+	}
+}
+
+func TestWaitRedirect(t *testing.T) {
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	c := newTestInstance(t, func(config *core.Config) {
+		config.Clock = clock
+		config.WaitDelay = 30 * time.Second
+	})
+	e := NewEndpoint(c)
+
+	r, err := setupRequest(newTestRequest(http.MethodGet, "/", "192.0.2.1"), c, RemoteAddrIP, nil)
+	if err != nil {
+		t.Fatalf("failed to set up request: %v", err)
+	}
+	challenge, err := challengeFor(r, c)
+	if err != nil {
+		t.Fatalf("failed to calculate challenge: %v", err)
+	}
+
+	ts := clock.now.Unix()
+	clock.now = clock.now.Add(c.WaitDelay)
+
+	for redir, expected := range map[string]string{
+		"/page?x=1":            "/page?x=1",
+		"https://example.com/": "/",
+		"//example.com/":       "/",
+	} {
+		nonce := core.NewNonce()
+		target := "/wait?" + url.Values{
+			"nonce":     {nonce.String()},
+			"ts":        {strconv.FormatInt(ts, 10)},
+			"signature": {calcWaitSignature(challenge, nonce, ts, c.WaitDelay, c)},
+			"redir":     {redir},
+		}.Encode()
+
+		w := serveEndpoint(t, e, newTestRequest(http.MethodGet, target, "192.0.2.1"))
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("%s: expected status 303, got %d: %s", redir, w.Code, w.Body)
+		}
+		if location := w.Header().Get("Location"); location != expected {
+			t.Errorf("%s: expected location %s, got %s", redir, expected, location)
+		}
+	}
+}
+
+// captchaForm returns the form of an image CAPTCHA whose answer is "ABCDEF", as issued to 192.0.2.1.
+func captchaForm(t *testing.T, c *core.Instance, nonce core.Nonce, redir string) url.Values {
+	t.Helper()
+
+	r, err := setupRequest(newTestRequest(http.MethodGet, "/", "192.0.2.1"), c, RemoteAddrIP, nil)
+	if err != nil {
+		t.Fatalf("failed to set up request: %v", err)
+	}
+	challenge, err := challengeFor(r, c)
+	if err != nil {
+		t.Fatalf("failed to calculate challenge: %v", err)
+	}
+
+	ts := c.Now().Unix()
+	return url.Values{
+		"nonce":            {nonce.String()},
+		"ts":               {strconv.FormatInt(ts, 10)},
+		"signature":        {calcCaptchaTicketSignature(challenge, nonce, ts, c)},
+		"answer_signature": {calcCaptchaSignature(challenge, nonce, ts, "ABCDEF", c)},
+		"answer":           {"abcdef"},
+		"redir":            {redir},
+	}
+}
+
+func postCaptcha(t *testing.T, e *Endpoint, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := newTestRequest(http.MethodPost, "/captcha", "192.0.2.1")
+	r.Body = io.NopCloser(strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serveEndpoint(t, e, r)
+}
+
+func TestCaptchaRedirect(t *testing.T) {
+	c := newTestInstance(t, func(config *core.Config) {
+		config.Captcha = true
+	})
+	e := NewEndpoint(c)
+
+	for redir, expected := range map[string]string{
+		"/page?x=1":            "/page?x=1",
+		"https://example.com/": "/",
+		"/\\example.com/":      "/",
+	} {
+		w := postCaptcha(t, e, captchaForm(t, c, core.NewNonce(), redir))
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("%s: expected status 303, got %d: %s", redir, w.Code, w.Body)
+		}
+		if location := w.Header().Get("Location"); location != expected {
+			t.Errorf("%s: expected location %s, got %s", redir, expected, location)
+		}
+	}
+}
+
+func TestCaptchaTicket(t *testing.T) {
+	c := newTestInstance(t, func(config *core.Config) {
+		config.Captcha = true
+	})
+	e := NewEndpoint(c)
+	nonce := core.NewNonce()
+
+	// A forged ticket is rejected before its nonce is used up.
+	forged := captchaForm(t, c, nonce, "/")
+	forged.Set("signature", strings.Repeat("0", 64))
+	if w := postCaptcha(t, e, forged); w.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403 for a forged ticket, got %d", w.Code)
+	}
+
+	if w := postCaptcha(t, e, captchaForm(t, c, nonce, "/")); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status 303, got %d: %s", w.Code, w.Body)
+	}
+
+	// A valid ticket takes a single guess.
+	if w := postCaptcha(t, e, captchaForm(t, c, nonce, "/")); w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a used nonce, got %d", w.Code)
+	}
+}
+
+func TestCaptchaPending(t *testing.T) {
+	c := newTestInstance(t, func(config *core.Config) {
+		config.Captcha = true
+	})
+	m := NewMiddleware(c, "/.cerberus")
+	e := NewEndpoint(c)
+
+	ipBlock, err := ipblock.NewIPBlock([]byte{192, 0, 2, 1}, c.PrefixCfg)
+	if err != nil {
+		t.Fatalf("failed to create IP block: %v", err)
+	}
+	expectPending := func(expected int32) {
+		t.Helper()
+		if pending := c.GetPending(ipBlock); pending != expected {
+			t.Errorf("expected %d pending, got %d", expected, pending)
+		}
+	}
+
+	serve(t, m, newTestRequest(http.MethodGet, "/page", "192.0.2.1"))
+	expectPending(1)
+
+	// The CAPTCHA linked from the challenge page, and its reloads, don't count again.
+	for range 2 {
+		if w := serveEndpoint(t, e, newTestRequest(http.MethodGet, "/captcha?redir=%2Fpage", "192.0.2.1")); w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+	}
+	expectPending(1)
+
+	wrong := captchaForm(t, c, core.NewNonce(), "/page")
+	wrong.Set("answer", "UVWXYZ")
+	postCaptcha(t, e, wrong)
+	expectPending(2)
+
+	if w := postCaptcha(t, e, captchaForm(t, c, core.NewNonce(), "/page")); w.Code != http.StatusSeeOther {
+		t.Fatalf("expected status 303, got %d", w.Code)
+	}
+	expectPending(1)
+}
+
+// solveChallenge solves every sub-puzzle of the challenge like the challenge page, and returns the solutions and responses.
+func solveChallenge(t *testing.T, input testChallengeInput, puzzles int) ([]uint64, []string) {
+	t.Helper()
+
+	solutions := make([]uint64, puzzles)
+	responses := make([]string, puzzles)
+	for i := range puzzles {
+		salt, err := blake3sum(fmt.Sprintf("%s|%s|%d|%s|%d|", input.Challenge, input.Nonce, input.TS, input.Signature, i))
+		if err != nil {
+			t.Fatalf("failed to calculate salt: %v", err)
+		}
+		for solution := uint64(0); ; solution++ {
+			answer, err := blake3Prf(salt, solution)
+			if err != nil {
+				t.Fatalf("failed to calculate answer: %v", err)
+			}
+			if checkAnswer(answer, input.Difficulty) {
+				solutions[i], responses[i] = solution, hex.EncodeToString(answer)
+				break
+			}
+		}
+	}
+	return solutions, responses
+}
+
+// answerBody returns the JSON answer that the challenge page submits.
+func answerBody(input testChallengeInput, solutions []uint64, responses []string, redir string) map[string]any {
+	return map[string]any{
+		"response":   responses,
+		"solution":   solutions,
+		"nonce":      input.Nonce,
+		"ts":         input.TS,
+		"signature":  input.Signature,
+		"difficulty": input.Difficulty,
+		"redir":      redir,
+	}
+}
+
+func postAnswer(t *testing.T, e *Endpoint, body map[string]any) (*httptest.ResponseRecorder, jsonResult) {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("failed to encode answer: %v", err)
+	}
+	r := newTestRequest(http.MethodPost, "/answer", "192.0.2.1")
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+
+	w := serveEndpoint(t, e, r)
+	var result jsonResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("failed to decode result: %v: %s", err, w.Body)
+	}
+	return w, result
+}
+
+func TestAnswer(t *testing.T) {
+	c := newTestInstance(t, func(config *core.Config) {
+		config.DifficultyBits = 6
+		config.Puzzles = 2
+	})
+	e := NewEndpoint(c)
+
+	t.Run("json", func(t *testing.T) {
+		input := fetchChallenge(t, e, nil)
+		solutions, responses := solveChallenge(t, input, c.Puzzles)
+
+		w, result := postAnswer(t, e, answerBody(input, solutions, responses, "/page"))
+		if w.Code != http.StatusOK || result.Outcome != "pass" || result.Redirect != "/page" {
+			t.Fatalf("expected to pass, got %d: %+v", w.Code, result)
+		}
+		if responseCookie(w, c.CookieName) == nil {
+			t.Error("expected an approval cookie")
+		}
+
+		w, result = postAnswer(t, e, answerBody(input, solutions, responses, "/page"))
+		if w.Code != http.StatusBadRequest || result.Reason != "nonce already used" {
+			t.Errorf("expected a reused answer to be rejected, got %d: %+v", w.Code, result)
+		}
+	})
+
+	t.Run("form", func(t *testing.T) {
+		input := fetchChallenge(t, e, nil)
+		solutions, responses := solveChallenge(t, input, c.Puzzles)
+
+		form := url.Values{
+			"response":   responses,
+			"nonce":      {input.Nonce},
+			"ts":         {strconv.FormatInt(input.TS, 10)},
+			"signature":  {input.Signature},
+			"difficulty": {strconv.Itoa(input.Difficulty)},
+			"redir":      {"/page"},
+		}
+		for _, solution := range solutions {
+			form.Add("solution", strconv.FormatUint(solution, 10))
+		}
+		r := newTestRequest(http.MethodPost, "/answer", "192.0.2.1")
+		r.Body = io.NopCloser(strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		w := serveEndpoint(t, e, r)
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/page" {
+			t.Errorf("expected a redirect to /page, got %d to %s", w.Code, w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		for redir, expected := range map[string]string{
+			"/page?x=1":             "/page?x=1",
+			"https://evil.example/": "/",
+			"//evil.example/":       "/",
+		} {
+			input := fetchChallenge(t, e, nil)
+			solutions, responses := solveChallenge(t, input, c.Puzzles)
+
+			_, result := postAnswer(t, e, answerBody(input, solutions, responses, redir))
+			if result.Outcome != "pass" || result.Redirect != expected {
+				t.Errorf("%s: expected to pass with redirect %s, got %+v", redir, expected, result)
+			}
+		}
+	})
+
+	t.Run("salts", func(t *testing.T) {
+		// Each sub-puzzle has its own salt, so solutions can't be reused across sub-puzzles.
+		var input testChallengeInput
+		var solutions []uint64
+		var responses []string
+		for solutions == nil || solutions[0] == solutions[1] {
+			input = fetchChallenge(t, e, nil)
+			solutions, responses = solveChallenge(t, input, c.Puzzles)
+		}
+		solutions[1], responses[1] = solutions[0], responses[0]
+
+		w, result := postAnswer(t, e, answerBody(input, solutions, responses, "/page"))
+		if w.Code != http.StatusForbidden || result.Outcome != "fail" {
+			t.Errorf("expected a reused solution to be rejected, got %d: %+v", w.Code, result)
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		input := fetchChallenge(t, e, nil)
+		solutions, responses := solveChallenge(t, input, c.Puzzles)
+
+		for name, modify := range map[string]func(map[string]any){
+			"boolean":      func(body map[string]any) { body["solution"] = []any{true, false} },
+			"object":       func(body map[string]any) { body["nonce"] = map[string]any{"value": input.Nonce} },
+			"null":         func(body map[string]any) { body["signature"] = nil },
+			"nested":       func(body map[string]any) { body["response"] = []any{responses} },
+			"too large":    func(body map[string]any) { body["redir"] = "/" + strings.Repeat("a", maxAnswerBodySize) },
+			"one solution": func(body map[string]any) { body["solution"] = solutions[:1] },
+		} {
+			body := answerBody(input, solutions, responses, "/page")
+			modify(body)
+			w, result := postAnswer(t, e, body)
+			if w.Code != http.StatusBadRequest || result.Outcome != "fail" {
+				t.Errorf("%s: expected the answer to be rejected, got %d: %+v", name, w.Code, result)
+			}
+		}
+
+		// None of them used up the challenge.
+		if w, result := postAnswer(t, e, answerBody(input, solutions, responses, "/page")); result.Outcome != "pass" {
+			t.Errorf("expected to pass after malformed answers, got %d: %+v", w.Code, result)
+		}
+	})
+}
+
+func TestAnswerTooFast(t *testing.T) {
+	clock := &testClock{now: time.Unix(1_700_000_000, 0)}
+	c := newTestInstance(t, func(config *core.Config) {
+		config.Clock = clock
+		config.DifficultyBits = 6
+		config.Puzzles = 2
+		config.MaxHashRate = 10
+	})
+	e := NewEndpoint(c)
+
+	ipBlock, err := ipblock.NewIPBlock([]byte{192, 0, 2, 1}, c.PrefixCfg)
+	if err != nil {
+		t.Fatalf("failed to create IP block: %v", err)
+	}
+
+	input := fetchChallenge(t, e, nil)
+	solutions, responses := solveChallenge(t, input, c.Puzzles)
+	w, result := postAnswer(t, e, answerBody(input, solutions, responses, "/page"))
+	if w.Code != http.StatusForbidden || result.Reason != "solved too fast" {
+		t.Fatalf("expected an instant answer to be rejected, got %d: %+v", w.Code, result)
+	}
+	if pending := c.GetPending(ipBlock); pending != 2 {
+		t.Errorf("expected the answer to count as pending, got %d pending", pending)
+	}
+
+	input = fetchChallenge(t, e, nil)
+	solutions, responses = solveChallenge(t, input, c.Puzzles)
+	var iterations uint64
+	for _, solution := range solutions {
+		iterations += solutionIterations(solution)
+	}
+	clock.now = clock.now.Add(c.MinSolveTime(iterations))
+	if w, result := postAnswer(t, e, answerBody(input, solutions, responses, "/page")); result.Outcome != "pass" {
+		t.Errorf("expected a plausible answer to pass, got %d: %+v", w.Code, result)
+	}
+}
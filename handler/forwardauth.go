@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/a-h/templ"
+	"github.com/invopop/ctxi18n/i18n"
+	"github.com/sjtug/cerberus/web"
+	"go.uber.org/zap"
+)
+
+// forwardedRequest returns a shallow copy of an auth subrequest with the method and URI of the original request.
+//
+// nginx doesn't forward them by default, so they are read from X-Original-Method and X-Original-URI if set in the
+// auth_request location. Traefik forwardAuth sends X-Forwarded-Method and X-Forwarded-Uri. The client IP must be
+// resolved from X-Forwarded-For by the ClientIP function, e.g. by Caddy if the frontend proxy is in trusted_proxies.
+func forwardedRequest(r *http.Request) *http.Request {
+	forwarded := *r
+
+	for _, name := range []string{"X-Original-Method", "X-Forwarded-Method"} {
+		if method := r.Header.Get(name); method != "" {
+			forwarded.Method = method
+			break
+		}
+	}
+
+	for _, name := range []string{"X-Original-URI", "X-Forwarded-Uri"} {
+		if uri := r.Header.Get(name); uri != "" {
+			if u, err := url.ParseRequestURI(uri); err == nil {
+				forwarded.URL = u
+				forwarded.RequestURI = uri
+			}
+			break
+		}
+	}
+
+	return &forwarded
+}
+
+// forwardAuthBaseURL returns the path that the endpoint is served under, assuming that the frontend proxy sends auth
+// subrequests to the same path as it exposes the endpoint.
+func forwardAuthBaseURL(r *http.Request) string {
+	path, _, _ := strings.Cut(originalRequestURI(r), "?")
+	return strings.TrimSuffix(strings.TrimSuffix(path, "/"), "/auth")
+}
+
+// forwardAuthHandle answers auth subrequests of other reverse proxies, e.g. nginx auth_request or Traefik forwardAuth.
+//
+// It responds 200 if the original request may pass, and 401 with the challenge page as the location otherwise.
+// Blocked clients get 403 in ServeHTTP. Navigations are only counted as pending once the challenge page is visited.
+//
+// The original method and URI are taken from the headers of whoever sends the request, so that anyone who can reach
+// this route can ask about, and use up the download links of, any URI. It must only be reachable by the frontend proxy.
+func (e *Endpoint) forwardAuthHandle(w http.ResponseWriter, r *http.Request) error {
+	c := e.instance
+
+	w.Header().Set("Cache-Control", "no-cache")
+
+	baseURL := forwardAuthBaseURL(r)
+	r = forwardedRequest(r)
+
+	if isPreflight(r) {
+		w.Header().Set(c.HeaderName, "PREFLIGHT")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	// The frontend proxy must copy Set-Cookie of auth responses to the client for cookie cohorts to stick.
+	rollout := inRollout(r, c)
+	setRolloutCookie(w, r)
+	if !rollout {
+		w.Header().Set(c.HeaderName, "ROLLOUT")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	approved, err := checkApproval(r, c, c.DecApproval, e.Logger)
+	if err != nil {
+		return err
+	}
+	if approved || checkDownloadSignature(r, c, c.DecApproval, e.Logger) {
+		w.Header().Set(c.HeaderName, "PASS")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	location := baseURL + "/challenge-page?" + url.Values{"redir": {r.URL.RequestURI()}}.Encode()
+
+	w.Header().Set(c.HeaderName, "CHALLENGE")
+	w.Header().Set("Location", location)
+	if !isNavigation(r) {
+		if countsAsPending(r, c) {
+			if ipBlock, ok := getIPBlock(r); ok && incPending(c, c.BlockState, ipBlock, e.Logger) {
+				return respondFailure(w, r, &c.Config, "IP blocked", true, http.StatusForbidden, baseURL)
+			}
+		}
+		challengeURL := baseURL + "/challenge"
+		w.Header().Set(ChallengeHeaderName, challengeURL)
+		return respondCompact(w, r, http.StatusUnauthorized, jsonResult{Outcome: "challenge", Challenge: challengeURL})
+	}
+
+	// Browsers don't follow the location of a 401 response. Proxies that pass the response through as is, like
+	// Traefik, need a page that navigates to the challenge instead.
+	return renderTemplate(w, r, &c.Config, baseURL, i18n.T(r.Context(), "challenge.title"), web.Redirect(location), templ.WithStatus(http.StatusUnauthorized))
+}
+
+// challengePageHandle renders the challenge page for clients sent here by forwardAuthHandle.
+func (e *Endpoint) challengePageHandle(w http.ResponseWriter, r *http.Request) error {
+	c := e.instance
+
+	w.Header().Set("Cache-Control", "no-cache")
+
+	redir := r.FormValue("redir")
+	if redir == "" {
+		e.Logger.Info("redir is empty")
+		return respondFailure(w, r, &c.Config, "redir is empty", false, http.StatusBadRequest, ".")
+	}
+	redir = localRedirect(redir)
+
+	e.Logger.Debug("serving challenge page for forward auth", zap.String("redir", redir))
+	return renderChallenge(w, r, c, ".", redir, e.Logger)
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sjtug/cerberus/internal/ipblock"
+)
+
+// newAuthRequest creates an auth subrequest for the original URI, as sent to the endpoint under /.cerberus.
+func newAuthRequest(header string, uri string, accept string) *http.Request {
+	r := newTestRequest(http.MethodGet, "/.cerberus/auth", "192.0.2.1")
+	r.URL.Path = "/auth" // as stripped by the router
+	r.Header.Set(header, uri)
+	r.Header.Set("Accept", accept)
+	return r
+}
+
+func serveEndpoint(t *testing.T, e *Endpoint, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	if err := e.Serve(w, r); err != nil {
+		t.Fatalf("failed to serve request: %v", err)
+	}
+	return w
+}
+
+func TestForwardAuth(t *testing.T) {
+	c := newTestInstance(t, nil)
+	e := NewEndpoint(c)
+
+	t.Run("navigation", func(t *testing.T) {
+		for _, header := range []string{"X-Original-URI", "X-Forwarded-Uri"} {
+			w := serveEndpoint(t, e, newAuthRequest(header, "/page?x=1", "text/html"))
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("%s: expected status 401, got %d", header, w.Code)
+			}
+			location := "/.cerberus/challenge-page?redir=%2Fpage%3Fx%3D1"
+			if got := w.Header().Get("Location"); got != location {
+				t.Errorf("%s: expected location %s, got %s", header, location, got)
+			}
+			// Proxies that pass the response through need a page that navigates to the challenge.
+			if body := w.Body.String(); !strings.Contains(body, `http-equiv="refresh"`) || !strings.Contains(body, "0;url=/.cerberus/challenge-page") {
+				t.Errorf("%s: expected a page that refreshes to the challenge page", header)
+			}
+		}
+	})
+
+	t.Run("non-navigation", func(t *testing.T) {
+		w := serveEndpoint(t, e, newAuthRequest("X-Original-URI", "/api/items", "application/json"))
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status 401, got %d", w.Code)
+		}
+		if got := w.Header().Get(ChallengeHeaderName); got != "/.cerberus/challenge" {
+			t.Errorf("expected the challenge header to point to the endpoint, got %q", got)
+		}
+		var result jsonResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if result.Outcome != "challenge" || result.Challenge != "/.cerberus/challenge" {
+			t.Errorf("expected a challenge result, got %+v", result)
+		}
+	})
+
+	t.Run("pass", func(t *testing.T) {
+		r := newAuthRequest("X-Original-URI", "/page", "text/html")
+		r.AddCookie(issueTestApproval(t, c, r, c.DifficultyBits))
+		w := serveEndpoint(t, e, r)
+		if w.Code != http.StatusOK || w.Header().Get(c.HeaderName) != "PASS" {
+			t.Errorf("expected an approved request to pass, got %d %q", w.Code, w.Header().Get(c.HeaderName))
+		}
+	})
+
+	t.Run("blocked", func(t *testing.T) {
+		ipBlock, err := ipblock.NewIPBlock([]byte{192, 0, 2, 1}, c.PrefixCfg)
+		if err != nil {
+			t.Fatalf("failed to create IP block: %v", err)
+		}
+		c.InsertBlocklist(ipBlock)
+
+		w := serveEndpoint(t, e, newAuthRequest("X-Original-URI", "/page", "text/html"))
+		if w.Code != http.StatusForbidden || w.Header().Get(c.HeaderName) != "BLOCKED" {
+			t.Errorf("expected a blocked client to get 403, got %d %q", w.Code, w.Header().Get(c.HeaderName))
+		}
+	})
+}
+
+func TestChallengePage(t *testing.T) {
+	c := newTestInstance(t, nil)
+	e := NewEndpoint(c)
+
+	for redir, expected := range map[string]bool{
+		"/page?x=1":             true,
+		"https://evil.example/": false,
+		"//evil.example/":       false,
+	} {
+		target := "/challenge-page?" + url.Values{"redir": {redir}}.Encode()
+		w := serveEndpoint(t, e, newTestRequest(http.MethodGet, target, "192.0.2.1"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", redir, w.Code)
+		}
+		if strings.Contains(w.Body.String(), redir) != expected {
+			t.Errorf("%s: expected the page to return to it: %v", redir, expected)
+		}
+	}
+}
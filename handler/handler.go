@@ -0,0 +1,180 @@
+// Package handler implements the cerberus request flow as plain net/http handlers, independent of Caddy.
+//
+// A Middleware challenges requests before they reach the protected handler, and an Endpoint serves the challenge
+// endpoints and static files under the base URL of the middleware:
+//
+//	instance, _ := core.GetInstance(config, logger)
+//	mux := http.NewServeMux()
+//	mux.Handle("/.cerberus/", http.StripPrefix("/.cerberus", handler.NewEndpoint(instance)))
+//	mux.Handle("/", handler.NewMiddleware(instance, "/.cerberus").Wrap(app))
+package handler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/internal/botscore"
+	"github.com/sjtug/cerberus/internal/ipblock"
+	"github.com/sjtug/cerberus/translations"
+	"github.com/sjtug/cerberus/web"
+	"go.uber.org/zap"
+)
+
+func init() {
+	LoadI18n(translations.FS)
+}
+
+// ClientIPFunc returns the IP address of the client that sent the request.
+type ClientIPFunc func(r *http.Request) string
+
+// RemoteAddrIP returns the IP address of the peer of the connection.
+func RemoteAddrIP(r *http.Request) string {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr // no port
+	}
+
+	return clientIP
+}
+
+// ForwardedClientIP returns a ClientIPFunc that trusts the X-Forwarded-For header of requests from trustedProxies.
+// The client IP is the rightmost address in X-Forwarded-For that isn't a trusted proxy itself.
+func ForwardedClientIP(trustedProxies []netip.Prefix) ClientIPFunc {
+	isTrusted := func(addr netip.Addr) bool {
+		for _, prefix := range trustedProxies {
+			if prefix.Contains(addr.Unmap()) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(r *http.Request) string {
+		clientIP := RemoteAddrIP(r)
+
+		addr, err := netip.ParseAddr(clientIP)
+		if err != nil || !isTrusted(addr) {
+			return clientIP
+		}
+
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			addr, err := netip.ParseAddr(hop)
+			if err != nil {
+				break
+			}
+			clientIP = hop
+			if !isTrusted(addr) {
+				break
+			}
+		}
+
+		return clientIP
+	}
+}
+
+// TLSFingerprint is the fingerprint of the TLS client hello of a connection.
+type TLSFingerprint struct {
+	// JA3 is the MD5 hash of the JA3 string.
+	JA3 string
+	// JA4 is the JA4 fingerprint, e.g. "t13d1516h2_8daaf6152771_e5627efa2ab1".
+	JA4 string
+}
+
+// TLSFingerprintFunc returns the TLS fingerprint of the connection of the request, or the zero value if it's unknown.
+type TLSFingerprintFunc func(r *http.Request) TLSFingerprint
+
+type contextKeyType int
+
+const stateCtxKey contextKeyType = iota
+
+// requestState is the state of a request shared by the handlers.
+type requestState struct {
+	clientIP string
+	ipBlock  ipblock.IPBlock
+	// hasIPBlock is false if the client IP can't be parsed.
+	hasIPBlock  bool
+	fingerprint TLSFingerprint
+	// score is the bot score of the request, and failedChecks are the checks that added to it.
+	score        int
+	failedChecks []string
+	action       botscore.Action
+	// difficultyBits is the challenge difficulty of a matching policy rule, or zero for the usual difficulty.
+	difficultyBits int
+	// rolloutCookie is a new rollout cookie to set on the response.
+	rolloutCookie *http.Cookie
+}
+
+func getState(r *http.Request) *requestState {
+	if state, ok := r.Context().Value(stateCtxKey).(*requestState); ok {
+		return state
+	}
+	return &requestState{}
+}
+
+func getClientIP(r *http.Request) string {
+	return getState(r).clientIP
+}
+
+// getIPBlock returns the IP block of the client, if its IP is valid.
+func getIPBlock(r *http.Request) (ipblock.IPBlock, bool) {
+	state := getState(r)
+	return state.ipBlock, state.hasIPBlock
+}
+
+// getAction returns what to do with the request according to its bot score.
+func getAction(r *http.Request) botscore.Action {
+	return getState(r).action
+}
+
+func getFingerprint(r *http.Request) TLSFingerprint {
+	return getState(r).fingerprint
+}
+
+// isBlocked reports whether the IP block of the client is blocked in blocks, or its TLS fingerprint is blocked.
+func isBlocked(r *http.Request, c *core.Instance, blocks *core.BlockState, logger *zap.Logger) bool {
+	if ipBlock, ok := getIPBlock(r); ok && blocks.ContainsBlocklist(ipBlock) {
+		logger.Debug("IP is blocked", zap.String("ip", ipBlock.ToIPNet(c.PrefixCfg).String()))
+		return true
+	}
+
+	if fp := getFingerprint(r); c.FingerprintBlocked(fp.JA4, fp.JA3) {
+		logger.Debug("TLS fingerprint is blocked", zap.String("ja4", fp.JA4), zap.String("ja3", fp.JA3))
+		return true
+	}
+
+	return false
+}
+
+// setupRequest sets up the request context: the client IP, TLS fingerprint, bot score, request ID, manifest and locale.
+// The TLS fingerprint is left empty if tlsFingerprint is nil.
+func setupRequest(r *http.Request, c *core.Instance, clientIP ClientIPFunc, tlsFingerprint TLSFingerprintFunc) (*http.Request, error) {
+	state := &requestState{clientIP: clientIP(r)}
+	if tlsFingerprint != nil {
+		state.fingerprint = tlsFingerprint(r)
+	}
+	if !c.BotScore.IsEmpty() {
+		state.score, state.failedChecks = c.BotScore.Score(r)
+		state.action = c.BotScore.Decide(state.score)
+	}
+	if ipBlock, err := ipblock.NewIPBlock(net.ParseIP(state.clientIP), c.PrefixCfg); err == nil {
+		state.ipBlock, state.hasIPBlock = ipBlock, true
+	}
+
+	manifest, err := web.LoadManifest()
+	if err != nil {
+		panic(err)
+	}
+
+	ctx := context.WithValue(r.Context(), stateCtxKey, state)
+	ctx = context.WithValue(ctx, web.RequestIDCtxKey, uuid.New().String())
+	ctx = context.WithValue(ctx, web.ManifestCtxKey, manifest)
+
+	return setupLocale(r.WithContext(ctx))
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/sjtug/cerberus/core"
+	"go.uber.org/zap"
+)
+
+// testClock is a clock that only moves when the test sets it.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func newTestInstance(t *testing.T, configure func(*core.Config)) *core.Instance {
+	t.Helper()
+
+	config := core.Config{MaxMemUsage: 16 << 20}
+	if configure != nil {
+		configure(&config)
+	}
+	if err := config.Provision(zap.NewNop()); err != nil {
+		t.Fatalf("failed to provision config: %v", err)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+
+	state, _, _, _, err := core.NewInstanceState(config)
+	if err != nil {
+		t.Fatalf("failed to create instance state: %v", err)
+	}
+	t.Cleanup(state.Close)
+
+	return &core.Instance{Config: config, InstanceState: state}
+}
+
+// newTestRequest creates a browser navigation from the given client IP.
+func newTestRequest(method string, target string, ip string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.RemoteAddr = net.JoinHostPort(ip, "1234")
+	r.Header.Set("Accept", "text/html")
+	return r
+}
+
+// serve runs the middleware on the request. It returns the response, and the request passed to the next handler or nil.
+func serve(t *testing.T, m *Middleware, r *http.Request) (*httptest.ResponseRecorder, *http.Request) {
+	t.Helper()
+
+	var passed *http.Request
+	next := http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		passed = r
+	})
+
+	w := httptest.NewRecorder()
+	if err := m.Serve(w, r, next); err != nil {
+		t.Fatalf("failed to serve request: %v", err)
+	}
+	return w, passed
+}
+
+// responseCookie returns the cookie with the given name set by the response, or nil.
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// issueTestApproval returns a cookie for the client of r, as if it passed a challenge of the given total difficulty.
+// Zero stands for a wait ticket or an image CAPTCHA.
+func issueTestApproval(t *testing.T, c *core.Instance, r *http.Request, difficultyBits int) *http.Cookie {
+	t.Helper()
+
+	r, err := setupRequest(r.Clone(r.Context()), c, RemoteAddrIP, nil)
+	if err != nil {
+		t.Fatalf("failed to set up request: %v", err)
+	}
+	challenge, err := challengeFor(r, c)
+	if err != nil {
+		t.Fatalf("failed to calculate challenge: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := issueApproval(w, r, c, challenge, "test", difficultyBits); err != nil {
+		t.Fatalf("failed to issue approval: %v", err)
+	}
+	cookie := responseCookie(w, c.CookieName)
+	if cookie == nil {
+		t.Fatal("no approval cookie was set")
+	}
+	return cookie
+}
+
+func TestForwardedClientIP(t *testing.T) {
+	clientIP := ForwardedClientIP([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("2001:db8::/32")})
+
+	tests := []struct {
+		name     string
+		peer     string
+		xff      []string
+		expected string
+	}{
+		{name: "untrusted peer", peer: "192.0.2.1:1234", xff: []string{"198.51.100.1"}, expected: "192.0.2.1"},
+		{name: "trusted peer", peer: "10.0.0.1:1234", xff: []string{"198.51.100.1"}, expected: "198.51.100.1"},
+		{name: "trusted peer without header", peer: "10.0.0.1:1234", expected: "10.0.0.1"},
+		{name: "trusted IPv6 peer", peer: "[2001:db8::1]:1234", xff: []string{"198.51.100.1"}, expected: "198.51.100.1"},
+		{name: "IPv4-mapped trusted peer", peer: "[::ffff:10.0.0.1]:1234", xff: []string{"198.51.100.1"}, expected: "198.51.100.1"},
+		{name: "peer without port", peer: "10.0.0.1", xff: []string{"198.51.100.1"}, expected: "198.51.100.1"},
+		{name: "chain of trusted proxies", peer: "10.0.0.1:1234", xff: []string{"198.51.100.1, 10.0.0.3, 10.0.0.2"}, expected: "198.51.100.1"},
+		{name: "rightmost untrusted hop", peer: "10.0.0.1:1234", xff: []string{"203.0.113.1, 198.51.100.1, 10.0.0.2"}, expected: "198.51.100.1"},
+		{name: "multiple headers", peer: "10.0.0.1:1234", xff: []string{"203.0.113.1", "198.51.100.1, 10.0.0.2"}, expected: "198.51.100.1"},
+		{name: "multiple headers ending in trusted hops", peer: "10.0.0.1:1234", xff: []string{"198.51.100.1", "10.0.0.3", "10.0.0.2"}, expected: "198.51.100.1"},
+		{name: "only trusted hops", peer: "10.0.0.1:1234", xff: []string{"10.0.0.3, 10.0.0.2"}, expected: "10.0.0.3"},
+		{name: "unparseable hop", peer: "10.0.0.1:1234", xff: []string{"unknown"}, expected: "10.0.0.1"},
+		{name: "unparseable hop behind trusted hop", peer: "10.0.0.1:1234", xff: []string{"203.0.113.1, unknown, 10.0.0.2"}, expected: "10.0.0.2"},
+		{name: "hop with port", peer: "10.0.0.1:1234", xff: []string{"198.51.100.1:5678"}, expected: "10.0.0.1"},
+		{name: "empty hop", peer: "10.0.0.1:1234", xff: []string{"198.51.100.1,"}, expected: "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.peer
+			for _, value := range tt.xff {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := clientIP(r); got != tt.expected {
+				t.Errorf("expected client IP %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
@@ -1,4 +1,4 @@
-package directives
+package handler
 
 import (
 	"io/fs"
@@ -6,6 +6,7 @@ import (
 	"github.com/invopop/ctxi18n"
 )
 
+// LoadI18n loads the translations in fs, in place of the embedded ones.
 func LoadI18n(fs fs.FS) {
 	if err := ctxi18n.LoadWithDefault(fs, "en"); err != nil {
 		panic(err)
@@ -0,0 +1,257 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/internal/botscore"
+	"github.com/sjtug/cerberus/internal/policy"
+	"go.uber.org/zap"
+)
+
+// Middleware challenges requests before they reach the protected handler.
+type Middleware struct {
+	// The base URL for the challenge. It must be the same as the deployed endpoint route.
+	BaseURL string
+	// If true, the middleware will not perform any challenge. It will only block known bad IPs.
+	BlockOnly bool
+	// If true, the middleware only observes: it runs the decision path against a shadow state, records the status each
+	// request would have had in logs and metrics, and passes every request to the next handler.
+	Observe bool
+	// ClientIP returns the IP of the client. Defaults to RemoteAddrIP.
+	ClientIP ClientIPFunc
+	// TLSFingerprint returns the TLS fingerprint of the client. Fingerprint rules don't apply if it's nil.
+	TLSFingerprint TLSFingerprintFunc
+	// Logger defaults to a no-op logger.
+	Logger *zap.Logger
+
+	instance *core.Instance
+	// policy is nil until SetPolicy is called.
+	policy *policy.Policy
+}
+
+// NewMiddleware creates a middleware with the given cerberus instance, whose endpoint is served under baseURL.
+func NewMiddleware(instance *core.Instance, baseURL string) *Middleware {
+	return &Middleware{
+		BaseURL:  baseURL,
+		ClientIP: RemoteAddrIP,
+		Logger:   zap.NewNop(),
+		instance: instance,
+	}
+}
+
+// ChallengeHeaderName is the response header that points clients which can't show a challenge page to the challenge endpoint.
+const ChallengeHeaderName = "X-Cerberus-Challenge"
+
+// isUpgrade reports whether the request asks to switch protocols, e.g. to WebSocket.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isPreflight reports whether the request is a CORS preflight request, which never carries cookies.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func (m *Middleware) invokeAuth(w http.ResponseWriter, r *http.Request) error {
+	c := m.instance
+
+	// Make sure the response is not cached so that users always see the latest challenge.
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if isUpgrade(r) {
+		// Upgrade requests can't show a challenge page. The page that opened them is challenged instead.
+		m.Logger.Debug("rejecting upgrade request without valid cookie")
+		w.Header().Set(c.HeaderName, "CHALLENGE")
+		http.Error(w, "Cerberus challenge required", http.StatusForbidden)
+		return nil
+	}
+	if r.Method == http.MethodHead {
+		// HEAD responses have no body, so there's no challenge to solve and nothing to count as pending.
+		w.Header().Set(c.HeaderName, "CHALLENGE")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Robots-Tag", "noindex")
+		w.WriteHeader(setChallengeStatus(w, &c.Config))
+		return nil
+	}
+	if !isNavigation(r) {
+		// Subresources and API requests can't show a challenge page. Point them to the challenge instead.
+		if countsAsPending(r, c) {
+			if ipBlock, ok := getIPBlock(r); ok && incPending(c, c.BlockState, ipBlock, m.Logger) {
+				return respondFailure(w, r, &c.Config, "IP blocked", true, http.StatusForbidden, m.BaseURL)
+			}
+		}
+		challengeURL := m.BaseURL + "/challenge"
+		if getState(r).difficultyBits != 0 {
+			// The endpoint doesn't know about the policy, so it's asked for the difficulty that the request requires.
+			challengeURL += "?" + url.Values{"difficulty": {strconv.Itoa(puzzleDifficultyBits(r, c))}}.Encode()
+		}
+		w.Header().Set(c.HeaderName, "CHALLENGE")
+		w.Header().Set(ChallengeHeaderName, challengeURL)
+		return respondCompact(w, r, http.StatusForbidden, jsonResult{Outcome: "challenge", Challenge: challengeURL})
+	}
+
+	return renderChallenge(w, r, c, m.BaseURL, "", m.Logger)
+}
+
+// Wrap returns a handler that challenges requests before passing them to next.
+func (m *Middleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := m.Serve(w, r, next); err != nil {
+			m.Logger.Error("failed to handle request", zap.Error(err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	})
+}
+
+// Serve challenges the request, and passes it to next if the client is allowed through.
+func (m *Middleware) Serve(w http.ResponseWriter, r *http.Request, next http.Handler) error {
+	c := m.instance
+
+	r, err := setupRequest(r, c, m.ClientIP, m.TLSFingerprint)
+	if err != nil {
+		return err
+	}
+
+	if m.Observe {
+		return m.observe(w, r, next)
+	}
+
+	status, r, err := m.decide(r, c.BlockState, c.DecApproval)
+	if err != nil {
+		return err
+	}
+	setRolloutCookie(w, r)
+
+	switch status {
+	case "BLOCKED":
+		return respondFailure(w, r, &c.Config, "", true, http.StatusForbidden, m.BaseURL)
+	case "CHALLENGE":
+		return m.invokeAuth(w, r)
+	}
+
+	// OK: Continue to the next handler
+	w.Header().Set(c.HeaderName, status)
+	next.ServeHTTP(w, r)
+	return nil
+}
+
+// decide runs the decision path of the middleware, and returns the status of the request: "BLOCKED", "CHALLENGE", or
+// "PASS", "DISABLED", "PREFLIGHT" or "ROLLOUT" along with the request to pass to the next handler.
+// IP blocks are looked up in and blocked in blocks, and approvals are redeemed with redeem, so that observe mode can run
+// the same path without affecting clients.
+func (m *Middleware) decide(r *http.Request, blocks *core.BlockState, redeem func(uuid.UUID) bool) (string, *http.Request, error) {
+	c := m.instance
+
+	if isBlocked(r, c, blocks, m.Logger) {
+		return "BLOCKED", r, nil
+	}
+
+	if m.BlockOnly {
+		// If block only mode is enabled, we don't need to perform any challenge.
+		return "DISABLED", r, nil
+	}
+
+	if isPreflight(r) {
+		// Browsers never send cookies with preflight requests, and would fail the actual request if challenged.
+		// Preflight requests don't reach the actual resource, so let them through without consuming approvals.
+		return "PREFLIGHT", r, nil
+	}
+
+	if !inRollout(r, c) {
+		// Clients outside of the rollout cohort pass as if there was no challenge.
+		return "ROLLOUT", r, nil
+	}
+
+	if rule := m.evaluatePolicy(r); rule != nil {
+		switch rule.Action {
+		case policy.Allow:
+			m.Logger.Debug("policy rule allows request", zap.String("expression", rule.Expression))
+			return "PASS", r, nil
+		case policy.Block:
+			m.Logger.Debug("policy rule blocks request", zap.String("expression", rule.Expression))
+			if ipBlock, ok := getIPBlock(r); ok && rule.BlockTTL > 0 {
+				blocks.InsertBlocklistFor(ipBlock, rule.BlockTTL)
+			}
+			return "BLOCKED", r, nil
+		case policy.Challenge:
+			m.Logger.Debug("policy rule challenges request", zap.String("expression", rule.Expression), zap.Int("difficulty_bits", rule.DifficultyBits))
+			getState(r).difficultyBits = rule.DifficultyBits
+		}
+	} else {
+		switch state := getState(r); state.action {
+		case botscore.Block:
+			m.Logger.Debug("bot score too high, blocking", zap.Int("score", state.score), zap.Strings("failed_checks", state.failedChecks))
+			return "BLOCKED", r, nil
+		case botscore.Allow:
+			// Requests that look like a consistent browser pass without a challenge.
+			return "PASS", r, nil
+		case botscore.Harder:
+			m.Logger.Debug("bot score high, challenge is harder", zap.Int("score", state.score), zap.Strings("failed_checks", state.failedChecks))
+		}
+	}
+
+	approved, err := checkApproval(r, c, redeem, m.Logger)
+	if err != nil {
+		return "", r, err
+	}
+	if approved {
+		return "PASS", r, nil
+	}
+	if checkDownloadSignature(r, c, redeem, m.Logger) {
+		return "PASS", withoutDownloadParam(r), nil
+	}
+	return "CHALLENGE", r, nil
+}
+
+// observe runs the decision path against the shadow state, records the status that the request would have had, and
+// passes the request to next regardless.
+func (m *Middleware) observe(w http.ResponseWriter, r *http.Request, next http.Handler) error {
+	c := m.instance
+	logger := m.Logger.With(zap.Bool("observe", true))
+
+	shadow, err := c.Shadow()
+	if err != nil {
+		return err
+	}
+
+	// Approvals are only peeked, so that observing doesn't use up the accesses of clients.
+	// Rollout cookies aren't set either, so that clients are assigned as if they had never been observed.
+	status, r, err := m.decide(r, shadow, c.PeekApproval)
+	if err != nil {
+		return err
+	}
+	if status == "CHALLENGE" && countsAsPending(r, c) {
+		// A challenge would be pending until solved. Nobody solves it in observe mode, so the pending counters are an
+		// upper bound, as if no client could solve challenges.
+		if ipBlock, ok := getIPBlock(r); ok && incPending(c, shadow, ipBlock, logger) {
+			status = "BLOCKED"
+		}
+	}
+
+	fields := []zap.Field{zap.String("status", status), zap.String("ip", getClientIP(r)), zap.String("uri", originalRequestURI(r))}
+	if status == "BLOCKED" {
+		logger.Info("request would have been blocked", fields...)
+	} else {
+		logger.Debug("observed request", fields...)
+	}
+	core.Metrics.ObservedDecisions.WithLabelValues(status).Inc()
+
+	w.Header().Set(c.HeaderName, "OBSERVE")
+	next.ServeHTTP(w, r)
+	return nil
+}
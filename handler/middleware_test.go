@@ -0,0 +1,232 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/internal/botscore"
+	"github.com/sjtug/cerberus/internal/ipblock"
+	"github.com/sjtug/cerberus/internal/policy"
+)
+
+func TestObserve(t *testing.T) {
+	c := newTestInstance(t, func(config *core.Config) {
+		config.MaxPending = 2
+		config.AccessPerApproval = 1
+		config.Rollout = &core.RolloutConfig{Percent: 100, By: core.RolloutByCookie}
+	})
+	m := NewMiddleware(c, "/.cerberus")
+	m.Observe = true
+	if err := m.SetPolicy([]PolicyRule{{Expression: `path == "/admin"`, Action: policy.Block, BlockTTL: time.Hour}}); err != nil {
+		t.Fatalf("failed to set policy: %v", err)
+	}
+	shadow, err := c.Shadow()
+	if err != nil {
+		t.Fatalf("failed to create shadow state: %v", err)
+	}
+
+	newIPBlock := func(ip []byte) ipblock.IPBlock {
+		ipBlock, err := ipblock.NewIPBlock(ip, c.PrefixCfg)
+		if err != nil {
+			t.Fatalf("failed to create IP block: %v", err)
+		}
+		return ipBlock
+	}
+
+	observe := func(r *http.Request) {
+		t.Helper()
+		w, passed := serve(t, m, r)
+		if passed == nil || w.Header().Get(c.HeaderName) != "OBSERVE" {
+			t.Fatalf("expected an observed request to pass, got %d %q", w.Code, w.Header().Get(c.HeaderName))
+		}
+		if cookies := w.Result().Cookies(); len(cookies) != 0 {
+			t.Errorf("expected observe mode not to set cookies, got %v", cookies)
+		}
+	}
+
+	t.Run("pending", func(t *testing.T) {
+		ipBlock := newIPBlock([]byte{192, 0, 2, 1})
+		for range 3 {
+			observe(newTestRequest(http.MethodGet, "/", "192.0.2.1"))
+		}
+		if !shadow.ContainsBlocklist(ipBlock) {
+			t.Error("expected the IP to be blocked in the shadow state after max_pending challenges")
+		}
+		if c.ContainsBlocklist(ipBlock) || c.GetPending(ipBlock) != 0 {
+			t.Errorf("expected the real state to be untouched, got %d pending", c.GetPending(ipBlock))
+		}
+	})
+
+	t.Run("policy block", func(t *testing.T) {
+		ipBlock := newIPBlock([]byte{192, 0, 2, 2})
+		observe(newTestRequest(http.MethodGet, "/admin", "192.0.2.2"))
+		if !shadow.ContainsBlocklist(ipBlock) {
+			t.Error("expected the IP to be blocked in the shadow state")
+		}
+		if c.ContainsBlocklist(ipBlock) {
+			t.Error("expected the IP not to be blocked in the real state")
+		}
+	})
+
+	t.Run("approval", func(t *testing.T) {
+		r := newTestRequest(http.MethodGet, "/", "192.0.2.3")
+		cookie := issueTestApproval(t, c, r, c.DifficultyBits)
+		for range 3 {
+			r := newTestRequest(http.MethodGet, "/", "192.0.2.3")
+			r.AddCookie(cookie)
+			observe(r)
+		}
+
+		// The only access of the approval is still there for the real middleware.
+		enforcing := NewMiddleware(c, "/.cerberus")
+		r = newTestRequest(http.MethodGet, "/", "192.0.2.3")
+		r.AddCookie(cookie)
+		w, passed := serve(t, enforcing, r)
+		if passed == nil || w.Header().Get(c.HeaderName) != "PASS" {
+			t.Errorf("expected the approval not to be used up by observing, got status %q", w.Header().Get(c.HeaderName))
+		}
+	})
+}
+
+func TestBotScore(t *testing.T) {
+	browser := func(r *http.Request) *http.Request {
+		r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:143.0) Gecko/20100101 Firefox/143.0")
+		r.Header.Set("Accept-Language", "en-US,en;q=0.5")
+		r.Header.Set("Accept-Encoding", "gzip, deflate, br, zstd")
+		return r
+	}
+	curl := func(r *http.Request) *http.Request {
+		r.Header.Set("User-Agent", "curl/8.5.0")
+		return r
+	}
+
+	tests := []struct {
+		name     string
+		botScore botscore.Config
+		client   func(*http.Request) *http.Request
+		expected string
+	}{
+		{name: "browser without thresholds", client: browser, expected: "CHALLENGE"},
+		{name: "bot without thresholds", client: curl, expected: "CHALLENGE"},
+		{name: "browser below challenge threshold", botScore: botscore.Config{ChallengeThreshold: 10}, client: browser, expected: "PASS"},
+		{name: "bot above challenge threshold", botScore: botscore.Config{ChallengeThreshold: 10}, client: curl, expected: "CHALLENGE"},
+		{name: "bot above block threshold", botScore: botscore.Config{ChallengeThreshold: 10, BlockThreshold: 30}, client: curl, expected: "BLOCKED"},
+		{name: "browser below block threshold", botScore: botscore.Config{BlockThreshold: 30}, client: browser, expected: "CHALLENGE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestInstance(t, func(config *core.Config) {
+				config.BotScore = tt.botScore
+			})
+			m := NewMiddleware(c, "/.cerberus")
+
+			w, passed := serve(t, m, tt.client(newTestRequest(http.MethodGet, "/", "192.0.2.1")))
+			if status := w.Header().Get(c.HeaderName); status != tt.expected {
+				t.Errorf("expected status %s, got %s", tt.expected, status)
+			}
+			if (passed != nil) != (tt.expected == "PASS") {
+				t.Errorf("expected the request to pass to be %v", tt.expected == "PASS")
+			}
+		})
+	}
+
+	t.Run("harder", func(t *testing.T) {
+		c := newTestInstance(t, func(config *core.Config) {
+			config.DifficultyBits = 8
+			config.WaitDelay = 30 * time.Second
+			config.Captcha = true
+			config.BotScore = botscore.Config{HarderThreshold: 30, HarderBits: 4}
+		})
+		m := NewMiddleware(c, "/.cerberus")
+
+		r, err := setupRequest(curl(newTestRequest(http.MethodGet, "/", "192.0.2.1")), c, RemoteAddrIP, nil)
+		if err != nil {
+			t.Fatalf("failed to set up request: %v", err)
+		}
+		if bits := puzzleDifficultyBits(r, c); bits != 12 {
+			t.Errorf("expected bots to get 12 bits of difficulty, got %d", bits)
+		}
+
+		approvals := []struct {
+			client         func(*http.Request) *http.Request
+			difficultyBits int
+			expected       string
+		}{
+			{client: curl, difficultyBits: 8, expected: "CHALLENGE"},
+			{client: curl, difficultyBits: 12, expected: "PASS"},
+			{client: browser, difficultyBits: 8, expected: "PASS"},
+			// Wait tickets and CAPTCHAs don't do the additional work.
+			{client: curl, difficultyBits: 0, expected: "CHALLENGE"},
+			{client: browser, difficultyBits: 0, expected: "PASS"},
+		}
+		for _, approval := range approvals {
+			r := approval.client(newTestRequest(http.MethodGet, "/", "192.0.2.1"))
+			r.AddCookie(issueTestApproval(t, c, r, approval.difficultyBits))
+			w, _ := serve(t, m, r)
+			if status := w.Header().Get(c.HeaderName); status != approval.expected {
+				t.Errorf("%s with %d bits: expected status %s, got %s", r.UserAgent(), approval.difficultyBits, approval.expected, status)
+			}
+		}
+
+		// So they're only offered to clients without additional difficulty.
+		w, _ := serve(t, m, curl(newTestRequest(http.MethodGet, "/", "192.0.2.1")))
+		if body := w.Body.String(); strings.Contains(body, "wait-form") || strings.Contains(body, "/captcha") {
+			t.Error("expected no wait ticket or CAPTCHA for bots with additional difficulty")
+		}
+		w, _ = serve(t, m, browser(newTestRequest(http.MethodGet, "/", "192.0.2.1")))
+		if body := w.Body.String(); !strings.Contains(body, "wait-form") || !strings.Contains(body, "/captcha") {
+			t.Error("expected a wait ticket and CAPTCHA for browsers")
+		}
+	})
+}
+
+func TestCompactChallengePending(t *testing.T) {
+	c := newTestInstance(t, func(config *core.Config) {
+		config.MaxPending = 3
+		config.AccessPerApproval = 1
+	})
+	m := NewMiddleware(c, "/.cerberus")
+
+	ipBlock, err := ipblock.NewIPBlock([]byte{192, 0, 2, 1}, c.PrefixCfg)
+	if err != nil {
+		t.Fatalf("failed to create IP block: %v", err)
+	}
+	fetch := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := newTestRequest(http.MethodGet, "/api", "192.0.2.1")
+		r.Header.Set("Accept", "application/json")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w, _ := serve(t, m, r)
+		return w
+	}
+
+	// Subresources of a page whose approval ran out aren't counted.
+	cookie := issueTestApproval(t, c, newTestRequest(http.MethodGet, "/api", "192.0.2.1"), 0)
+	if status := fetch(cookie).Header().Get(c.HeaderName); status != "PASS" {
+		t.Fatalf("expected the first access to pass, got %s", status)
+	}
+	for range 5 {
+		if status := fetch(cookie).Header().Get(c.HeaderName); status != "CHALLENGE" {
+			t.Fatalf("expected a used up approval to be challenged, got %s", status)
+		}
+	}
+	if pending := c.GetPending(ipBlock); pending != 0 {
+		t.Errorf("expected clients with an approval cookie not to be counted, got %d pending", pending)
+	}
+
+	// Clients without one are, until they're blocked.
+	for i := range 3 {
+		if status := fetch(nil).Header().Get(c.HeaderName); status != "CHALLENGE" {
+			t.Fatalf("request %d: expected to be challenged, got %s", i, status)
+		}
+	}
+	if status := fetch(nil).Header().Get(c.HeaderName); status != "BLOCKED" {
+		t.Errorf("expected to be blocked after max_pending compact challenges, got %s", status)
+	}
+}
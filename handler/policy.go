@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/internal/policy"
+	"go.uber.org/zap"
+)
+
+// PolicyRule is a CEL rule that decides what the middleware does with matching requests.
+type PolicyRule = policy.Rule
+
+// SetPolicy compiles the rules that the middleware evaluates on every request. The first matching rule wins over the
+// bot score, and requests that match no rule are handled as without a policy.
+func (m *Middleware) SetPolicy(rules []PolicyRule) error {
+	c := m.instance
+
+	for i, rule := range rules {
+		if minBits := 1 - c.PuzzleBits(0); rule.DifficultyBits != 0 && (rule.DifficultyBits < minBits || rule.DifficultyBits > core.MaxDifficultyBits) {
+			return fmt.Errorf("rule %d: difficulty_bits must be between %d and %d", i, minBits, core.MaxDifficultyBits)
+		}
+	}
+
+	compiled, err := policy.Compile(rules)
+	if err != nil {
+		return err
+	}
+	m.policy = compiled
+	return nil
+}
+
+// evaluatePolicy returns the first rule of the policy that matches the request, or nil if there's none.
+func (m *Middleware) evaluatePolicy(r *http.Request) *PolicyRule {
+	if m.policy == nil {
+		return nil
+	}
+
+	c := m.instance
+	state := getState(r)
+
+	input := policy.Input{
+		ClientIP:  state.clientIP,
+		BotScore:  state.score,
+		BotChecks: state.failedChecks,
+		JA4:       state.fingerprint.JA4,
+		JA3:       state.fingerprint.JA3,
+	}
+	if state.hasIPBlock {
+		input.IPBlock = state.ipBlock.ToIPNet(c.PrefixCfg).String()
+		input.Pending = c.GetPending(state.ipBlock)
+	}
+
+	rule, err := m.policy.Evaluate(r, input)
+	if err != nil {
+		m.Logger.Debug("failed to evaluate policy rules", zap.Error(err))
+	}
+	return rule
+}
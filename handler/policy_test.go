@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/internal/ipblock"
+	"github.com/sjtug/cerberus/internal/policy"
+)
+
+func newPolicyMiddleware(t *testing.T, configure func(*core.Config)) (*core.Instance, *Middleware) {
+	t.Helper()
+
+	c := newTestInstance(t, configure)
+	m := NewMiddleware(c, "/.cerberus")
+	err := m.SetPolicy([]PolicyRule{
+		{Expression: `path.startsWith("/public/")`, Action: policy.Allow},
+		{Expression: `path == "/admin"`, Action: policy.Block, BlockTTL: time.Hour},
+		{Expression: `path == "/probe"`, Action: policy.Block},
+		{Expression: `path.startsWith("/hard/")`, Action: policy.Challenge, DifficultyBits: 16},
+	})
+	if err != nil {
+		t.Fatalf("failed to set policy: %v", err)
+	}
+	return c, m
+}
+
+func TestPolicyAllow(t *testing.T) {
+	c, m := newPolicyMiddleware(t, nil)
+
+	w, passed := serve(t, m, newTestRequest(http.MethodGet, "/public/app.js", "192.0.2.1"))
+	if passed == nil || w.Header().Get(c.HeaderName) != "PASS" {
+		t.Errorf("expected an allowed request to pass, got status %q", w.Header().Get(c.HeaderName))
+	}
+
+	w, passed = serve(t, m, newTestRequest(http.MethodGet, "/", "192.0.2.1"))
+	if passed != nil || w.Header().Get(c.HeaderName) != "CHALLENGE" {
+		t.Errorf("expected requests that match no rule to be challenged, got status %q", w.Header().Get(c.HeaderName))
+	}
+}
+
+func TestPolicyBlock(t *testing.T) {
+	c, m := newPolicyMiddleware(t, nil)
+
+	w, passed := serve(t, m, newTestRequest(http.MethodGet, "/probe", "192.0.2.1"))
+	if passed != nil || w.Code != http.StatusForbidden || w.Header().Get(c.HeaderName) != "BLOCKED" {
+		t.Errorf("expected a blocked request to be rejected, got %d %q", w.Code, w.Header().Get(c.HeaderName))
+	}
+	w, _ = serve(t, m, newTestRequest(http.MethodGet, "/public/app.js", "192.0.2.1"))
+	if w.Header().Get(c.HeaderName) != "PASS" {
+		t.Errorf("expected a block without block_ttl not to block the IP, got status %q", w.Header().Get(c.HeaderName))
+	}
+
+	w, passed = serve(t, m, newTestRequest(http.MethodGet, "/admin", "192.0.2.2"))
+	if passed != nil || w.Code != http.StatusForbidden {
+		t.Errorf("expected a blocked request to be rejected, got %d", w.Code)
+	}
+	ipBlock, err := ipblock.NewIPBlock([]byte{192, 0, 2, 2}, c.PrefixCfg)
+	if err != nil {
+		t.Fatalf("failed to create IP block: %v", err)
+	}
+	if !c.ContainsBlocklist(ipBlock) {
+		t.Error("expected a block with block_ttl to block the IP")
+	}
+	w, passed = serve(t, m, newTestRequest(http.MethodGet, "/public/app.js", "192.0.2.2"))
+	if passed != nil || w.Header().Get(c.HeaderName) != "BLOCKED" {
+		t.Errorf("expected the blocked IP to be rejected on any path, got status %q", w.Header().Get(c.HeaderName))
+	}
+}
+
+func TestPolicyChallengeDifficulty(t *testing.T) {
+	c, m := newPolicyMiddleware(t, func(config *core.Config) {
+		config.DifficultyBits = 8
+		config.WaitDelay = 5 * time.Second
+	})
+
+	// Clients that can't show a challenge page are asked for the difficulty of the rule.
+	r := newTestRequest(http.MethodGet, "/hard/file", "192.0.2.1")
+	r.Header.Set("Accept", "application/json")
+	w, _ := serve(t, m, r)
+	var result jsonResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if result.Challenge != "/.cerberus/challenge?difficulty=16" {
+		t.Errorf("expected the challenge URL to carry the difficulty, got %q", result.Challenge)
+	}
+
+	// The wait ticket is only offered where it's accepted.
+	w, _ = serve(t, m, newTestRequest(http.MethodGet, "/hard/file", "192.0.2.1"))
+	if strings.Contains(w.Body.String(), "wait-form") {
+		t.Error("expected no wait ticket on a route with raised difficulty")
+	}
+	w, _ = serve(t, m, newTestRequest(http.MethodGet, "/", "192.0.2.1"))
+	if !strings.Contains(w.Body.String(), "wait-form") {
+		t.Error("expected a wait ticket on a route with the usual difficulty")
+	}
+
+	tests := []struct {
+		name           string
+		difficultyBits int
+		path           string
+		expected       string
+	}{
+		{name: "usual difficulty on hard route", difficultyBits: 8, path: "/hard/file", expected: "CHALLENGE"},
+		{name: "usual difficulty on usual route", difficultyBits: 8, path: "/", expected: "PASS"},
+		{name: "raised difficulty on hard route", difficultyBits: 16, path: "/hard/file", expected: "PASS"},
+		{name: "wait ticket on hard route", difficultyBits: 0, path: "/hard/file", expected: "CHALLENGE"},
+		{name: "wait ticket on usual route", difficultyBits: 0, path: "/", expected: "PASS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRequest(http.MethodGet, tt.path, "192.0.2.1")
+			r.AddCookie(issueTestApproval(t, c, r, tt.difficultyBits))
+
+			w, passed := serve(t, m, r)
+			if status := w.Header().Get(c.HeaderName); status != tt.expected {
+				t.Errorf("expected status %s, got %s", tt.expected, status)
+			}
+			if (passed != nil) != (tt.expected == "PASS") {
+				t.Errorf("expected the request to pass to be %v", tt.expected == "PASS")
+			}
+		})
+	}
+}
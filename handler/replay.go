@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/sjtug/cerberus/core"
+	"github.com/zeebo/blake3"
+)
+
+// replayRequest is a non-GET request stashed across a challenge, so that the client can re-submit it after passing.
+type replayRequest struct {
+	Method      string `json:"method"`
+	URL         string `json:"url"`
+	ContentType string `json:"contentType,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+	// Expires is the Unix time after which the stashed request can no longer be replayed.
+	Expires int64 `json:"expires"`
+}
+
+// replayAEAD returns the cipher used to seal stashed requests. The key is derived from the signing key.
+func replayAEAD(c *core.Instance) (cipher.AEAD, error) {
+	var key [32]byte
+	blake3.DeriveKey(IV5, c.GetPrivateKey().Seed(), key[:])
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// isSameOrigin reports whether the request was sent by a page of the same host, according to Sec-Fetch-Site, or Origin
+// and Referer for browsers without Fetch Metadata.
+func isSameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin"
+	}
+
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	u, err := url.Parse(source)
+	return err == nil && u.Host != "" && u.Host == r.Host
+}
+
+// stashRequest seals the method and body of a non-GET request, bound to the challenge of the client.
+// It returns an empty string if the request doesn't need to be or can't be stashed.
+//
+// Only requests from the same origin are stashed. The replay is sent from the challenge page with first-party cookies,
+// which would turn a cross-site request into a same-site one and get around SameSite cookies of the backend.
+func stashRequest(r *http.Request, challenge string, c *core.Instance) (string, error) {
+	if c.ReplayBodyLimit == 0 || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		return "", nil
+	}
+	if !isSameOrigin(r) {
+		return "", nil
+	}
+	if r.ContentLength > c.ReplayBodyLimit {
+		return "", nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, c.ReplayBodyLimit+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read body: %w", err)
+	}
+	if int64(len(body)) > c.ReplayBodyLimit {
+		return "", nil
+	}
+
+	plaintext, err := json.Marshal(replayRequest{
+		Method:      r.Method,
+		URL:         originalRequestURI(r),
+		ContentType: r.Header.Get("Content-Type"),
+		Body:        body,
+		Expires:     c.Now().Add(core.ReplayTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := replayAEAD(c)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	_, _ = rand.Read(nonce) // never returns an error
+
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, []byte(challenge))), nil
+}
+
+// openReplay opens a stashed request sealed by stashRequest for the same challenge.
+func openReplay(sealed string, challenge string, c *core.Instance) (*replayRequest, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := replayAEAD(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < aead.NonceSize() {
+		return nil, errors.New("sealed request too short")
+	}
+	plaintext, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], []byte(challenge))
+	if err != nil {
+		return nil, err
+	}
+
+	var replay replayRequest
+	if err := json.Unmarshal(plaintext, &replay); err != nil {
+		return nil, err
+	}
+	if c.Now().Unix() > replay.Expires {
+		return nil, errors.New("stashed request expired")
+	}
+
+	return &replay, nil
+}
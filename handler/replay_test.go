@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sjtug/cerberus/core"
+)
+
+const testChallenge = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestStashRequest(t *testing.T) {
+	c := newTestInstance(t, func(config *core.Config) {
+		config.ReplayBodyLimit = 16
+	})
+
+	tests := []struct {
+		name    string
+		method  string
+		body    string
+		headers map[string]string
+		stashed bool
+	}{
+		{name: "same origin", method: http.MethodPost, body: "a=1", headers: map[string]string{"Sec-Fetch-Site": "same-origin"}, stashed: true},
+		{name: "cross site", method: http.MethodPost, body: "a=1", headers: map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "http://example.com"}, stashed: false},
+		{name: "same site", method: http.MethodPost, body: "a=1", headers: map[string]string{"Sec-Fetch-Site": "same-site"}, stashed: false},
+		{name: "matching origin", method: http.MethodPost, body: "a=1", headers: map[string]string{"Origin": "http://example.com"}, stashed: true},
+		{name: "foreign origin", method: http.MethodPost, body: "a=1", headers: map[string]string{"Origin": "https://evil.example"}, stashed: false},
+		{name: "opaque origin", method: http.MethodPost, body: "a=1", headers: map[string]string{"Origin": "null"}, stashed: false},
+		{name: "matching referer", method: http.MethodPost, body: "a=1", headers: map[string]string{"Referer": "http://example.com/edit"}, stashed: true},
+		{name: "foreign referer", method: http.MethodPost, body: "a=1", headers: map[string]string{"Referer": "https://evil.example/example.com"}, stashed: false},
+		{name: "unknown origin", method: http.MethodPost, body: "a=1", stashed: false},
+		{name: "GET", method: http.MethodGet, headers: map[string]string{"Sec-Fetch-Site": "same-origin"}, stashed: false},
+		{name: "body too large", method: http.MethodPost, body: strings.Repeat("a", 17), headers: map[string]string{"Sec-Fetch-Site": "same-origin"}, stashed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://example.com/form?id=1", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+
+			sealed, err := stashRequest(r, testChallenge, c)
+			if err != nil {
+				t.Fatalf("failed to stash request: %v", err)
+			}
+			if (sealed != "") != tt.stashed {
+				t.Fatalf("expected stashed to be %v, got %q", tt.stashed, sealed)
+			}
+			if sealed == "" {
+				return
+			}
+
+			replay, err := openReplay(sealed, testChallenge, c)
+			if err != nil {
+				t.Fatalf("failed to open stashed request: %v", err)
+			}
+			if replay.Method != tt.method || replay.URL != "http://example.com/form?id=1" || string(replay.Body) != tt.body ||
+				replay.ContentType != "application/x-www-form-urlencoded" {
+				t.Errorf("stashed request doesn't match, got %+v", *replay)
+			}
+		})
+	}
+}
+
+func TestOpenReplay(t *testing.T) {
+	clock := &testClock{now: time.Unix(1_700_000_000, 0)}
+	c := newTestInstance(t, func(config *core.Config) {
+		config.ReplayBodyLimit = 1024
+		config.Clock = clock
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/form", strings.NewReader("a=1"))
+	r.Header.Set("Sec-Fetch-Site", "same-origin")
+	sealed, err := stashRequest(r, testChallenge, c)
+	if err != nil || sealed == "" {
+		t.Fatalf("failed to stash request: %q, %v", sealed, err)
+	}
+
+	if _, err := openReplay(sealed, strings.Repeat("f", len(testChallenge)), c); err == nil {
+		t.Error("expected a stashed request not to open for another challenge")
+	}
+
+	tampered := []byte(sealed)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := openReplay(string(tampered), testChallenge, c); err == nil {
+		t.Error("expected a tampered stashed request not to open")
+	}
+
+	if _, err := openReplay(sealed, testChallenge, c); err != nil {
+		t.Errorf("expected the stashed request to open, got %v", err)
+	}
+
+	clock.now = clock.now.Add(core.ReplayTTL + time.Second)
+	if _, err := openReplay(sealed, testChallenge, c); err == nil {
+		t.Error("expected an expired stashed request not to open")
+	}
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sjtug/cerberus/core"
+)
+
+// rolloutCookieTTL is how long a client keeps its place in the rollout cohort.
+const rolloutCookieTTL = 365 * 24 * time.Hour
+
+// rolloutCookieName returns the name of the cookie that assigns clients to the rollout cohort.
+func rolloutCookieName(c *core.Instance) string {
+	return c.CookieName + "-rollout"
+}
+
+// calcRolloutSignature authenticates the ID of a rollout cookie, so that clients can't pick an ID outside of the cohort.
+// Like calcCaptchaSignature, it's a MAC keyed by the private key, as only cerberus has to verify it.
+func calcRolloutSignature(id string, c *core.Instance) string {
+	payload := fmt.Sprintf("Rollout=%s,IV=%s", id, IV7)
+
+	mac := hmac.New(sha256.New, c.GetPrivateKey().Seed())
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// rolloutID returns the ID of a rollout cookie value, if its signature is valid.
+func rolloutID(value string, c *core.Instance) (string, bool) {
+	id, signature, ok := strings.Cut(value, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(calcRolloutSignature(id, c))) {
+		return "", false
+	}
+	return id, true
+}
+
+// inRollout reports whether the client is in the rollout cohort, i.e. whether it may be challenged.
+//
+// By cookie, clients without a valid rollout cookie are in the cohort, so that dropping or forging the cookie doesn't
+// skip the challenge. They get a new cookie, which setRolloutCookie sets on the response and which decides from the
+// next request on.
+func inRollout(r *http.Request, c *core.Instance) bool {
+	if c.Rollout == nil {
+		return true
+	}
+
+	if c.Rollout.By == core.RolloutByCookie {
+		if cookie, err := r.Cookie(rolloutCookieName(c)); err == nil {
+			if id, ok := rolloutID(cookie.Value, c); ok {
+				return c.InRollout(id)
+			}
+		}
+
+		id := uuid.New().String()
+		getState(r).rolloutCookie = &http.Cookie{
+			Name:     rolloutCookieName(c),
+			Value:    id + "." + calcRolloutSignature(id, c),
+			Expires:  c.Now().Add(rolloutCookieTTL),
+			SameSite: http.SameSiteLaxMode,
+			HttpOnly: true,
+			Path:     "/",
+		}
+		return true
+	}
+
+	ipBlock, ok := getIPBlock(r)
+	if !ok {
+		// Clients with an invalid IP can't be assigned, so they're challenged as without rollout.
+		return true
+	}
+	return c.InRollout(ipBlock.ToIPNet(c.PrefixCfg).String())
+}
+
+// setRolloutCookie sets the rollout cookie issued by inRollout, if any.
+func setRolloutCookie(w http.ResponseWriter, r *http.Request) {
+	if cookie := getState(r).rolloutCookie; cookie != nil {
+		http.SetCookie(w, cookie)
+	}
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/sjtug/cerberus/core"
+)
+
+// signedRolloutID returns a signed rollout cookie value whose ID is in or out of the cohort as requested.
+func signedRolloutID(c *core.Instance, in bool) (string, string) {
+	for {
+		id := uuid.New().String()
+		if c.InRollout(id) == in {
+			return id, id + "." + calcRolloutSignature(id, c)
+		}
+	}
+}
+
+func TestRolloutByCookie(t *testing.T) {
+	c := newTestInstance(t, func(config *core.Config) {
+		config.Rollout = &core.RolloutConfig{Percent: 50, By: core.RolloutByCookie}
+	})
+	m := NewMiddleware(c, "/.cerberus")
+	name := rolloutCookieName(c)
+
+	outID, outValue := signedRolloutID(c, false)
+	_, inValue := signedRolloutID(c, true)
+
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+		issued   bool
+	}{
+		{name: "missing", value: "", expected: "CHALLENGE", issued: true},
+		{name: "valid outside of the cohort", value: outValue, expected: "ROLLOUT", issued: false},
+		{name: "valid in the cohort", value: inValue, expected: "CHALLENGE", issued: false},
+		{name: "unsigned", value: outID, expected: "CHALLENGE", issued: true},
+		{name: "forged", value: outID + "." + calcRolloutSignature(uuid.New().String(), c), expected: "CHALLENGE", issued: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRequest(http.MethodGet, "/", "192.0.2.1")
+			if tt.value != "" {
+				r.AddCookie(&http.Cookie{Name: name, Value: tt.value})
+			}
+
+			w, _ := serve(t, m, r)
+			if status := w.Header().Get(c.HeaderName); status != tt.expected {
+				t.Errorf("expected status %s, got %s", tt.expected, status)
+			}
+
+			cookie := responseCookie(w, name)
+			if (cookie != nil) != tt.issued {
+				t.Fatalf("expected a new cookie to be issued to be %v, got %v", tt.issued, cookie)
+			}
+			if cookie != nil {
+				if _, ok := rolloutID(cookie.Value, c); !ok {
+					t.Errorf("expected the new cookie to be signed, got %q", cookie.Value)
+				}
+			}
+		})
+	}
+}
+
+func TestRolloutByIPBlock(t *testing.T) {
+	c := newTestInstance(t, func(config *core.Config) {
+		config.Rollout = &core.RolloutConfig{Percent: 50}
+	})
+	m := NewMiddleware(c, "/.cerberus")
+
+	counts := map[string]int{}
+	for i := range 256 {
+		ip := fmt.Sprintf("198.51.100.%d", i)
+		w, _ := serve(t, m, newTestRequest(http.MethodGet, "/", ip))
+		status := w.Header().Get(c.HeaderName)
+		counts[status]++
+
+		if cookie := responseCookie(w, rolloutCookieName(c)); cookie != nil {
+			t.Errorf("expected no rollout cookie by IP block, got %v", cookie)
+		}
+		if expected := c.InRollout(ip + "/32"); expected != (status == "CHALLENGE") {
+			t.Errorf("%s: expected in rollout to be %v, got status %s", ip, expected, status)
+		}
+	}
+	if counts["CHALLENGE"] == 0 || counts["ROLLOUT"] == 0 || counts["CHALLENGE"]+counts["ROLLOUT"] != 256 {
+		t.Errorf("expected clients to be split into challenged and passed, got %v", counts)
+	}
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sjtug/cerberus/core"
+	"go.uber.org/zap"
+)
+
+const (
+	// telemetryIterationSlack is the number of iterations per sub-puzzle that a solver may compute without reporting.
+	telemetryIterationSlack = 1 << 16
+	// telemetryElapsedSlack is the tolerance when comparing client and server measured time.
+	telemetryElapsedSlack = time.Second
+	// maxTelemetryElapsed and maxTelemetryIterations bound the reported values, so that comparing them can't overflow.
+	// They're far beyond what any challenge takes.
+	maxTelemetryElapsed    = 24 * time.Hour
+	maxTelemetryIterations = 1 << 62
+)
+
+// solverTelemetry is the solve statistics measured and reported by the challenge page.
+type solverTelemetry struct {
+	// Elapsed is the time taken to solve all sub-puzzles.
+	Elapsed time.Duration
+	// Iterations is the total number of hashes computed by all solver threads.
+	Iterations uint64
+	// HashRate is the hash rate of all solver threads combined (hashes per second).
+	HashRate float64
+}
+
+// parseTelemetry parses the solver telemetry from the answer form. Values that are too large are clamped.
+// Returns false if any field is missing or malformed, which is typical for native solvers.
+func parseTelemetry(r *http.Request) (solverTelemetry, bool) {
+	elapsedMs, err := strconv.ParseUint(r.FormValue("elapsed"), 10, 64)
+	if err != nil {
+		return solverTelemetry{}, false
+	}
+	iterations, err := strconv.ParseUint(r.FormValue("iterations"), 10, 64)
+	if err != nil {
+		return solverTelemetry{}, false
+	}
+	hashRate, err := strconv.ParseFloat(r.FormValue("hashrate"), 64)
+	if err != nil || math.IsNaN(hashRate) || math.IsInf(hashRate, 0) || hashRate < 0 {
+		return solverTelemetry{}, false
+	}
+
+	elapsedMs = min(elapsedMs, uint64(maxTelemetryElapsed/time.Millisecond))
+
+	return solverTelemetry{
+		Elapsed:    time.Duration(elapsedMs) * time.Millisecond, // #nosec G115 -- clamped
+		Iterations: min(iterations, maxTelemetryIterations),
+		HashRate:   hashRate,
+	}, true
+}
+
+// telemetryAnomalies returns the reasons why the reported telemetry is inconsistent with the solutions
+// (given as the minimum number of iterations) and the time elapsed since the challenge was issued.
+func telemetryAnomalies(t solverTelemetry, puzzles int, solutionIters uint64, serverElapsed time.Duration) []string {
+	var reasons []string
+
+	if t.Elapsed > serverElapsed+telemetryElapsedSlack {
+		reasons = append(reasons, "elapsed_exceeds_server")
+	}
+
+	slack := uint64(puzzles) * telemetryIterationSlack // #nosec G115 -- validated to be positive
+	if t.Iterations+slack < solutionIters {
+		reasons = append(reasons, "iterations_below_solution")
+	}
+
+	expectedIters := t.HashRate * t.Elapsed.Seconds()
+	if math.Abs(expectedIters-float64(t.Iterations)) > float64(t.Iterations)/4+float64(slack) {
+		reasons = append(reasons, "inconsistent_rate")
+	}
+
+	return reasons
+}
+
+// recordTelemetry logs and exports the solver telemetry of a solved challenge, and flags anomalous solvers.
+func recordTelemetry(r *http.Request, puzzles int, solutionIters uint64, serverElapsed time.Duration, logger *zap.Logger) {
+	t, ok := parseTelemetry(r)
+	if !ok {
+		core.Metrics.SolverAnomalies.WithLabelValues("missing_telemetry").Inc()
+		logger.Info("anomalous solver", zap.Strings("reasons", []string{"missing_telemetry"}))
+		return
+	}
+
+	core.Metrics.SolverHashRate.Observe(t.HashRate)
+	core.Metrics.SolverSolveTime.Observe(t.Elapsed.Seconds())
+
+	reasons := telemetryAnomalies(t, puzzles, solutionIters, serverElapsed)
+	fields := []zap.Field{
+		zap.Duration("elapsed", t.Elapsed),
+		zap.Duration("server_elapsed", serverElapsed),
+		zap.Uint64("iterations", t.Iterations),
+		zap.Uint64("solution_iterations", solutionIters),
+		zap.Float64("hash_rate", t.HashRate),
+	}
+	if len(reasons) > 0 {
+		for _, reason := range reasons {
+			core.Metrics.SolverAnomalies.WithLabelValues(reason).Inc()
+		}
+		logger.Info("anomalous solver", append(fields, zap.Strings("reasons", reasons))...)
+	} else {
+		logger.Debug("solver telemetry", fields...)
+	}
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTelemetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		form     url.Values
+		expected solverTelemetry
+		ok       bool
+	}{
+		{
+			name:     "valid",
+			form:     url.Values{"elapsed": {"1500"}, "iterations": {"3000000"}, "hashrate": {"2000000"}},
+			expected: solverTelemetry{Elapsed: 1500 * time.Millisecond, Iterations: 3_000_000, HashRate: 2_000_000},
+			ok:       true,
+		},
+		{name: "missing", form: url.Values{"elapsed": {"1500"}, "iterations": {"3000000"}}, ok: false},
+		{name: "negative elapsed", form: url.Values{"elapsed": {"-1"}, "iterations": {"1"}, "hashrate": {"1"}}, ok: false},
+		{
+			name:     "clamped",
+			form:     url.Values{"elapsed": {"18446744073709551615"}, "iterations": {"18446744073709551615"}, "hashrate": {"1"}},
+			expected: solverTelemetry{Elapsed: maxTelemetryElapsed, Iterations: maxTelemetryIterations, HashRate: 1},
+			ok:       true,
+		},
+		{name: "elapsed overflow", form: url.Values{"elapsed": {"18446744073709551616"}, "iterations": {"1"}, "hashrate": {"1"}}, ok: false},
+		{name: "fractional iterations", form: url.Values{"elapsed": {"1"}, "iterations": {"1.5"}, "hashrate": {"1"}}, ok: false},
+		{name: "negative hashrate", form: url.Values{"elapsed": {"1"}, "iterations": {"1"}, "hashrate": {"-1"}}, ok: false},
+		{name: "NaN hashrate", form: url.Values{"elapsed": {"1"}, "iterations": {"1"}, "hashrate": {"NaN"}}, ok: false},
+		{name: "infinite hashrate", form: url.Values{"elapsed": {"1"}, "iterations": {"1"}, "hashrate": {"+Inf"}}, ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/answer", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			telemetry, ok := parseTelemetry(r)
+			if ok != tt.ok {
+				t.Fatalf("expected ok to be %v, got %v", tt.ok, ok)
+			}
+			if telemetry != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, telemetry)
+			}
+		})
+	}
+}
+
+func TestTelemetryAnomalies(t *testing.T) {
+	tests := []struct {
+		name          string
+		telemetry     solverTelemetry
+		solutionIters uint64
+		serverElapsed time.Duration
+		expected      []string
+	}{
+		{
+			name:          "consistent",
+			telemetry:     solverTelemetry{Elapsed: 2 * time.Second, Iterations: 4_000_000, HashRate: 2_000_000},
+			solutionIters: 3_000_000,
+			serverElapsed: 3 * time.Second,
+			expected:      nil,
+		},
+		{
+			name:          "elapsed below server",
+			telemetry:     solverTelemetry{Elapsed: 100 * time.Millisecond, Iterations: 200_000, HashRate: 2_000_000},
+			solutionIters: 100_000,
+			serverElapsed: time.Minute,
+			expected:      nil,
+		},
+		{
+			name:          "elapsed exceeds server",
+			telemetry:     solverTelemetry{Elapsed: 10 * time.Second, Iterations: 20_000_000, HashRate: 2_000_000},
+			solutionIters: 3_000_000,
+			serverElapsed: 3 * time.Second,
+			expected:      []string{"elapsed_exceeds_server"},
+		},
+		{
+			name:          "iterations below solution",
+			telemetry:     solverTelemetry{Elapsed: 2 * time.Second, Iterations: 1_000_000, HashRate: 500_000},
+			solutionIters: 3_000_000,
+			serverElapsed: 3 * time.Second,
+			expected:      []string{"iterations_below_solution"},
+		},
+		{
+			name:          "implausible hashrate",
+			telemetry:     solverTelemetry{Elapsed: 2 * time.Second, Iterations: 4_000_000, HashRate: 1_000_000_000},
+			solutionIters: 3_000_000,
+			serverElapsed: 3 * time.Second,
+			expected:      []string{"inconsistent_rate"},
+		},
+		{
+			name:          "clamped",
+			telemetry:     solverTelemetry{Elapsed: maxTelemetryElapsed, Iterations: maxTelemetryIterations, HashRate: 1},
+			solutionIters: 3_000_000,
+			serverElapsed: 3 * time.Second,
+			expected:      []string{"elapsed_exceeds_server", "inconsistent_rate"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reasons := telemetryAnomalies(tt.telemetry, 1, tt.solutionIters, tt.serverElapsed)
+			if !slices.Equal(reasons, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, reasons)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sjtug/cerberus/core"
+	"github.com/sjtug/cerberus/web"
+	"go.uber.org/zap"
+)
+
+// widgetTokenSubject marks the tokens issued to the form protection widget, so that they can't be used as cookies and vice versa.
+const widgetTokenSubject = "widget"
+
+// siteverifyResult is the response of the siteverify route.
+type siteverifyResult struct {
+	Success bool `json:"success"`
+	// ChallengeTS is the time when the token was issued.
+	ChallengeTS string `json:"challenge_ts,omitempty"`
+	// IP is the IP address of the client that solved the challenge.
+	IP         string   `json:"ip,omitempty"`
+	ErrorCodes []string `json:"error-codes,omitempty"`
+}
+
+// widgetDisabled responds 404 and returns true if the widget is disabled, i.e. no siteverify secret is set.
+func (e *Endpoint) widgetDisabled(w http.ResponseWriter, r *http.Request) (bool, error) {
+	c := e.instance
+
+	if c.SiteverifySecret != "" {
+		return false, nil
+	}
+	e.Logger.Info("widget is disabled without siteverify_secret")
+	return true, respondFailure(w, r, &c.Config, "widget is disabled", false, http.StatusNotFound, ".")
+}
+
+// widgetScriptHandle redirects to the widget script, whose file name changes with every build.
+func (e *Endpoint) widgetScriptHandle(w http.ResponseWriter, r *http.Request) error {
+	c := e.instance
+
+	if disabled, err := e.widgetDisabled(w, r); disabled {
+		return err
+	}
+
+	manifest, err := web.LoadManifest()
+	if err != nil {
+		return err
+	}
+	asset, ok := manifest["js/widget.mjs"]
+	if !ok {
+		return respondFailure(w, r, &c.Config, "Not found", false, http.StatusNotFound, ".")
+	}
+
+	// Relative to the widget script URL, which is the only URL of the endpoint known without the base URL.
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Location", "static/"+asset.File)
+	w.WriteHeader(http.StatusFound)
+	return nil
+}
+
+// tokenHandle verifies a PoW answer from the widget and returns a single-use token to be submitted with the form.
+func (e *Endpoint) tokenHandle(w http.ResponseWriter, r *http.Request) error {
+	c := e.instance
+
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if disabled, err := e.widgetDisabled(w, r); disabled {
+		return err
+	}
+
+	challenge, _, _, err := e.verifyAnswer(w, r)
+	var rejection *answerRejection
+	if errors.As(err, &rejection) {
+		return respondFailure(w, r, &c.Config, rejection.msg, rejection.blocked, rejection.status, ".")
+	}
+	if err != nil {
+		return err
+	}
+
+	now := c.Now()
+	expires := now.Add(c.ChallengeTTL)
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{
+		"sub":       widgetTokenSubject,
+		"nonce":     core.NewNonce().String(),
+		"challenge": challenge,
+		"ip":        getClientIP(r),
+		"iat":       now.Unix(),
+		"exp":       expires.Unix(),
+	})
+	tokenStr, err := token.SignedString(c.GetPrivateKey())
+	if err != nil {
+		e.Logger.Error("failed to sign token", zap.Error(err))
+		return err
+	}
+
+	decPending(r, c)
+
+	e.Logger.Debug("widget passed the challenge")
+
+	w.Header().Set(c.HeaderName, "PASS")
+	return writeJSON(w, http.StatusOK, struct {
+		Outcome string `json:"outcome"`
+		Token   string `json:"token"`
+		Expires int64  `json:"expires"`
+	}{"pass", tokenStr, expires.Unix()})
+}
+
+// siteverifyHandle validates a widget token on behalf of the backend. Each token can only be validated once.
+//
+// The backend must send SiteverifySecret, so that nobody else holding a token can use it up before the backend does.
+// Tokens aren't bound to a site or form, so backends sharing an instance accept each other's tokens.
+func (e *Endpoint) siteverifyHandle(w http.ResponseWriter, r *http.Request) error {
+	c := e.instance
+
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if disabled, err := e.widgetDisabled(w, r); disabled {
+		return err
+	}
+
+	fail := func(code string) error {
+		return writeJSON(w, http.StatusOK, siteverifyResult{ErrorCodes: []string{code}})
+	}
+
+	if hasJSONBody(r) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxAnswerBodySize)
+		if err := parseJSONForm(r); err != nil {
+			e.Logger.Debug("malformed JSON body", zap.Error(err))
+			return fail("bad-request")
+		}
+	}
+
+	secret := r.FormValue("secret")
+	if secret == "" {
+		return fail("missing-input-secret")
+	}
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(c.SiteverifySecret)) != 1 {
+		e.Logger.Debug("invalid siteverify secret")
+		return fail("invalid-input-secret")
+	}
+
+	tokenStr := r.FormValue("token")
+	if tokenStr == "" {
+		return fail("missing-input-response")
+	}
+
+	token, err := jwt.ParseWithClaims(tokenStr, jwt.MapClaims{}, func(_ *jwt.Token) (interface{}, error) {
+		return c.GetPublicKey(), nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithSubject(widgetTokenSubject),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(c.Now),
+	)
+	if err != nil {
+		e.Logger.Debug("invalid widget token", zap.Error(err))
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return fail("timeout-or-duplicate")
+		}
+		return fail("invalid-input-response")
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	nonceStr, _ := claims["nonce"].(string)
+	nonce, err := core.ParseNonce(nonceStr)
+	if err != nil {
+		e.Logger.Debug("invalid widget token nonce", zap.Error(err))
+		return fail("invalid-input-response")
+	}
+	if !c.InsertUsedNonce(nonce) {
+		e.Logger.Debug("widget token already used")
+		return fail("timeout-or-duplicate")
+	}
+
+	result := siteverifyResult{Success: true}
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		result.ChallengeTS = iat.UTC().Format(time.RFC3339)
+	}
+	result.IP, _ = claims["ip"].(string)
+	return writeJSON(w, http.StatusOK, result)
+}
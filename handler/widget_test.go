@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sjtug/cerberus/core"
+)
+
+const testSiteverifySecret = "hunter2"
+
+// signTestWidgetToken returns a widget token issued at the current time of the instance, as tokenHandle does.
+func signTestWidgetToken(t *testing.T, c *core.Instance) string {
+	t.Helper()
+
+	now := c.Now()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{
+		"sub":       widgetTokenSubject,
+		"nonce":     core.NewNonce().String(),
+		"challenge": testChallenge,
+		"ip":        "192.0.2.1",
+		"iat":       now.Unix(),
+		"exp":       now.Add(c.ChallengeTTL).Unix(),
+	}).SignedString(c.GetPrivateKey())
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return token
+}
+
+func siteverify(t *testing.T, e *Endpoint, form url.Values) siteverifyResult {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/siteverify", strings.NewReader(form.Encode()))
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	w := serveEndpoint(t, e, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var result siteverifyResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return result
+}
+
+func expectSiteverifyError(t *testing.T, result siteverifyResult, code string) {
+	t.Helper()
+
+	if result.Success || !slices.Equal(result.ErrorCodes, []string{code}) {
+		t.Errorf("expected error %s, got %+v", code, result)
+	}
+}
+
+func TestSiteverify(t *testing.T) {
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	c := newTestInstance(t, func(config *core.Config) {
+		config.Clock = clock
+		config.SiteverifySecret = testSiteverifySecret
+	})
+	e := NewEndpoint(c)
+
+	t.Run("single use", func(t *testing.T) {
+		token := signTestWidgetToken(t, c)
+
+		result := siteverify(t, e, url.Values{"token": {token}, "secret": {testSiteverifySecret}})
+		if !result.Success || result.IP != "192.0.2.1" || result.ChallengeTS != "2023-11-14T22:13:20Z" {
+			t.Fatalf("expected the token to be valid, got %+v", result)
+		}
+		expectSiteverifyError(t, siteverify(t, e, url.Values{"token": {token}, "secret": {testSiteverifySecret}}), "timeout-or-duplicate")
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		token := signTestWidgetToken(t, c)
+		clock.now = clock.now.Add(c.ChallengeTTL + time.Second)
+		expectSiteverifyError(t, siteverify(t, e, url.Values{"token": {token}, "secret": {testSiteverifySecret}}), "timeout-or-duplicate")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		expectSiteverifyError(t, siteverify(t, e, url.Values{"secret": {testSiteverifySecret}}), "missing-input-response")
+		expectSiteverifyError(t, siteverify(t, e, url.Values{"token": {"not-a-token"}, "secret": {testSiteverifySecret}}), "invalid-input-response")
+
+		other := newTestInstance(t, nil)
+		expectSiteverifyError(t, siteverify(t, e, url.Values{"token": {signTestWidgetToken(t, other)}, "secret": {testSiteverifySecret}}), "invalid-input-response")
+	})
+}
+
+func TestSiteverifySecret(t *testing.T) {
+	c := newTestInstance(t, func(config *core.Config) {
+		config.SiteverifySecret = testSiteverifySecret
+	})
+	e := NewEndpoint(c)
+	token := signTestWidgetToken(t, c)
+
+	expectSiteverifyError(t, siteverify(t, e, url.Values{"token": {token}}), "missing-input-secret")
+	expectSiteverifyError(t, siteverify(t, e, url.Values{"token": {token}, "secret": {"hunter3"}}), "invalid-input-secret")
+
+	// Requests without the secret must not use up the token.
+	if result := siteverify(t, e, url.Values{"token": {token}, "secret": {testSiteverifySecret}}); !result.Success {
+		t.Fatalf("expected the token to be valid, got %+v", result)
+	}
+	expectSiteverifyError(t, siteverify(t, e, url.Values{"token": {token}, "secret": {testSiteverifySecret}}), "timeout-or-duplicate")
+}
+
+func TestWidgetDisabled(t *testing.T) {
+	c := newTestInstance(t, nil)
+	e := NewEndpoint(c)
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/widget.js", nil),
+		httptest.NewRequest(http.MethodPost, "/token", nil),
+		httptest.NewRequest(http.MethodPost, "/siteverify", nil),
+	} {
+		if w := serveEndpoint(t, e, r); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404 without siteverify_secret, got %d", r.URL.Path, w.Code)
+		}
+	}
+}
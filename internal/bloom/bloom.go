@@ -0,0 +1,127 @@
+// Package bloom implements a memory-bounded set of recently seen keys using rotating bloom filters.
+package bloom
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/zeebo/xxh3"
+)
+
+type filter struct {
+	words []uint64
+	// set is the number of set bits.
+	set uint64
+}
+
+func (f *filter) size() uint64 {
+	return uint64(len(f.words)) * 64
+}
+
+// fill returns the fraction of set bits.
+func (f *filter) fill() float64 {
+	return float64(f.set) / float64(f.size())
+}
+
+func (f *filter) reset() {
+	clear(f.words)
+	f.set = 0
+}
+
+// Rotating is a set of recently seen keys made of two bloom filter generations.
+// Inserted keys are remembered for at least one rotation period, and at most two.
+//
+// As with any bloom filter, a key that was never inserted may be reported as present.
+// After n insertions into a generation of m bits with k hashes, the false positive rate is about (1 - e^(-kn/m))^k.
+// There are no false negatives within the rotation period.
+type Rotating struct {
+	mu        sync.Mutex
+	current   *filter
+	previous  *filter
+	hashes    int
+	period    time.Duration
+	rotatedAt time.Time
+	now       func() time.Time
+}
+
+// NewRotating creates a rotating bloom filter using at most size bytes, with the given number of hashes per key.
+// The now function tells the current time.
+func NewRotating(size int64, hashes int, period time.Duration, now func() time.Time) *Rotating {
+	// Each generation takes half of the memory.
+	words := max(size/2/8, 1)
+
+	return &Rotating{
+		current:   &filter{words: make([]uint64, words)},
+		previous:  &filter{words: make([]uint64, words)},
+		hashes:    max(hashes, 1),
+		period:    period,
+		rotatedAt: now(),
+		now:       now,
+	}
+}
+
+// rotate drops the previous generation if the current one is older than the rotation period.
+func (r *Rotating) rotate() {
+	now := r.now()
+	elapsed := now.Sub(r.rotatedAt)
+	if elapsed < r.period {
+		return
+	}
+
+	r.previous.reset()
+	if elapsed < 2*r.period {
+		r.current, r.previous = r.previous, r.current
+	} else {
+		// Both generations are stale.
+		r.current.reset()
+	}
+	r.rotatedAt = now
+}
+
+// InsertIfAbsent inserts the key and returns true, or returns false if the key is (probably) already present.
+func (r *Rotating) InsertIfAbsent(key []byte) bool {
+	hash := xxh3.Hash128(key)
+	// Derive all indexes from two hashes (double hashing). The step is odd so that it's never zero.
+	h1, h2 := hash.Lo, hash.Hi|1
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rotate()
+
+	size := r.current.size()
+	inCurrent, inPrevious := true, true
+	for i := range uint64(r.hashes) { // #nosec G115 -- positive
+		index := (h1 + i*h2) % size
+		word, mask := index/64, uint64(1)<<(index%64)
+		inCurrent = inCurrent && r.current.words[word]&mask != 0
+		inPrevious = inPrevious && r.previous.words[word]&mask != 0
+	}
+	if inCurrent || inPrevious {
+		return false
+	}
+
+	for i := range uint64(r.hashes) { // #nosec G115 -- positive
+		index := (h1 + i*h2) % size
+		word, mask := index/64, uint64(1)<<(index%64)
+		if r.current.words[word]&mask == 0 {
+			r.current.words[word] |= mask
+			r.current.set++
+		}
+	}
+	return true
+}
+
+// FalsePositiveRate estimates the probability that a key that was never inserted is reported as present.
+func (r *Rotating) FalsePositiveRate() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rotate()
+
+	k := float64(r.hashes)
+	current := math.Pow(r.current.fill(), k)
+	previous := math.Pow(r.previous.fill(), k)
+	return 1 - (1-current)*(1-previous)
+}
@@ -0,0 +1,108 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"testing"
+	"time"
+)
+
+func popcount(f *filter) uint64 {
+	var n uint64
+	for _, word := range f.words {
+		n += uint64(bits.OnesCount64(word))
+	}
+	return n
+}
+
+func key(i uint64) []byte {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[8:], i)
+	return buf[:]
+}
+
+func newTestFilter(size int64, hashes int, period time.Duration) (*Rotating, *time.Time) {
+	now := time.Unix(1700000000, 0)
+	f := NewRotating(size, hashes, period, func() time.Time { return now })
+	return f, &now
+}
+
+func TestInsertIfAbsent(t *testing.T) {
+	f, _ := newTestFilter(1<<16, 7, time.Minute)
+
+	for i := range uint64(1000) {
+		if !f.InsertIfAbsent(key(i)) {
+			t.Fatalf("expected key %d to be absent", i)
+		}
+	}
+	for i := range uint64(1000) {
+		if f.InsertIfAbsent(key(i)) {
+			t.Fatalf("expected key %d to be present", i)
+		}
+	}
+
+	if got, expected := f.current.set, popcount(f.current); got != expected {
+		t.Errorf("expected %d set bits, counted %d", expected, got)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	f, now := newTestFilter(1<<16, 7, time.Minute)
+
+	if !f.InsertIfAbsent(key(1)) {
+		t.Fatal("expected key to be absent")
+	}
+
+	// Keys are remembered for at least one period.
+	*now = now.Add(90 * time.Second)
+	if f.InsertIfAbsent(key(1)) {
+		t.Error("expected key to be remembered after one rotation")
+	}
+
+	// And forgotten after two.
+	*now = now.Add(90 * time.Second)
+	if !f.InsertIfAbsent(key(1)) {
+		t.Error("expected key to be forgotten after two rotations")
+	}
+
+	// Long idle periods clear both generations.
+	*now = now.Add(time.Hour)
+	if !f.InsertIfAbsent(key(1)) {
+		t.Error("expected key to be forgotten after a long idle period")
+	}
+	if f.previous.set != 0 {
+		t.Errorf("expected previous generation to be empty, got %d set bits", f.previous.set)
+	}
+}
+
+func TestFalsePositiveRate(t *testing.T) {
+	// 10 bits per key with the optimal number of hashes gives a false positive rate of about 1%.
+	const size, keys = 1 << 16, 26214
+	f, _ := newTestFilter(size, 7, time.Minute)
+
+	if rate := f.FalsePositiveRate(); rate != 0 {
+		t.Errorf("expected no false positives when empty, got %f", rate)
+	}
+
+	for i := range uint64(keys) {
+		f.InsertIfAbsent(key(i))
+	}
+
+	estimate := f.FalsePositiveRate()
+
+	// Probing inserts keys, so only probe a few to keep the filter at about the same fill.
+	const probes = 2000
+	var falsePositives int
+	for i := range uint64(probes) {
+		if !f.InsertIfAbsent(key(i + 1<<32)) {
+			falsePositives++
+		}
+	}
+	measured := float64(falsePositives) / probes
+	if estimate <= 0.005 || estimate > 0.03 {
+		t.Errorf("expected an estimated false positive rate of about 0.01, got %f", estimate)
+	}
+	if measured > 0.03 {
+		t.Errorf("expected a measured false positive rate of about 0.01, got %f", measured)
+	}
+}
@@ -0,0 +1,286 @@
+// Package botscore scores how likely a request comes from a bot, by checking that its properties are consistent with
+// the browser it claims to be.
+package botscore
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultHarderBits is the number of difficulty bits added for clients that get a harder challenge.
+const DefaultHarderBits = 4
+
+// Action is what to do with a request, depending on its score.
+type Action int
+
+// Challenge is the zero value, so that requests are challenged as without scoring unless decided otherwise.
+const (
+	// Challenge asks the client to solve a challenge, as without scoring.
+	Challenge Action = iota
+	// Allow lets the request through without a challenge.
+	Allow
+	// Harder asks the client to solve a challenge with additional difficulty.
+	Harder
+	// Block rejects the request.
+	Block
+)
+
+func (a Action) String() string {
+	switch a {
+	case Allow:
+		return "allow"
+	case Challenge:
+		return "challenge"
+	case Harder:
+		return "harder"
+	case Block:
+		return "block"
+	default:
+		return "unknown"
+	}
+}
+
+// Config configures the scoring of requests. Without thresholds, every request is challenged as without scoring.
+type Config struct {
+	// Weights overrides the weights of checks by name. A weight of zero disables the check.
+	Weights map[string]int `json:"weights,omitempty"`
+	// ChallengeThreshold is the score from which requests are challenged. Requests with a lower score are allowed.
+	ChallengeThreshold int `json:"challenge_threshold,omitempty"`
+	// HarderThreshold is the score from which challenges get HarderBits of additional difficulty. Zero disables it.
+	HarderThreshold int `json:"harder_threshold,omitempty"`
+	// HarderBits is the additional difficulty of harder challenges in leading zero bits.
+	HarderBits int `json:"harder_bits,omitempty"`
+	// BlockThreshold is the score from which requests are blocked. Zero disables it.
+	BlockThreshold int `json:"block_threshold,omitempty"`
+}
+
+// IsEmpty reports whether no threshold is set, so that scores don't affect decisions.
+func (c Config) IsEmpty() bool {
+	return c.ChallengeThreshold == 0 && c.HarderThreshold == 0 && c.BlockThreshold == 0
+}
+
+func ValidateConfig(cfg Config) error {
+	for name, weight := range cfg.Weights {
+		if _, ok := findCheck(name); !ok {
+			return fmt.Errorf("unknown check %q", name)
+		}
+		if weight < 0 {
+			return fmt.Errorf("weight of %s must not be negative", name)
+		}
+	}
+	if cfg.ChallengeThreshold < 0 || cfg.HarderThreshold < 0 || cfg.BlockThreshold < 0 {
+		return fmt.Errorf("thresholds must not be negative")
+	}
+	if cfg.HarderThreshold != 0 && cfg.HarderThreshold < cfg.ChallengeThreshold {
+		return fmt.Errorf("harder_threshold must not be lower than challenge_threshold")
+	}
+	if cfg.BlockThreshold != 0 && (cfg.BlockThreshold < cfg.ChallengeThreshold || cfg.BlockThreshold < cfg.HarderThreshold) {
+		return fmt.Errorf("block_threshold must not be lower than the other thresholds")
+	}
+	if cfg.HarderBits < 0 {
+		return fmt.Errorf("harder_bits must not be negative")
+	}
+	return nil
+}
+
+// Decide maps a score to an action.
+func (c Config) Decide(score int) Action {
+	switch {
+	case c.BlockThreshold != 0 && score >= c.BlockThreshold:
+		return Block
+	case c.HarderThreshold != 0 && score >= c.HarderThreshold:
+		return Harder
+	case score >= c.ChallengeThreshold:
+		return Challenge
+	default:
+		return Allow
+	}
+}
+
+// Score runs the checks on the request, and returns the total score and the names of the checks that failed.
+//
+// Checks only look at properties that stay the same across the requests of a page load, including the fetch
+// requests of the challenge page, so that every request of a client gets the same score.
+func (c Config) Score(r *http.Request) (int, []string) {
+	client := parseUserAgent(r.Header.Get("User-Agent"))
+
+	score := 0
+	var failed []string
+	for _, check := range checks {
+		weight, ok := c.Weights[check.name]
+		if !ok {
+			weight = check.weight
+		}
+		if weight == 0 || !check.fails(r, client) {
+			continue
+		}
+		score += weight
+		failed = append(failed, check.name)
+	}
+	return score, failed
+}
+
+// browser is the browser that a User-Agent claims to be.
+type browser struct {
+	chromium bool
+	firefox  bool
+	safari   bool
+	// version is the major version of the browser.
+	version int
+}
+
+func (b browser) isBrowser() bool {
+	return b.chromium || b.firefox || b.safari
+}
+
+var (
+	chromiumVersionRe = regexp.MustCompile(`Chrome/(\d+)`)
+	firefoxVersionRe  = regexp.MustCompile(`Firefox/(\d+)`)
+	safariVersionRe   = regexp.MustCompile(`Version/(\d+)(?:\.(\d+))?.* Safari/`)
+	automationRe      = regexp.MustCompile(`(?i)curl|wget|python|aiohttp|httpx|go-http-client|java/|okhttp|libwww-perl|scrapy|headless|phantomjs|puppeteer|playwright|selenium|node-fetch|axios`)
+	languageRangeRe   = regexp.MustCompile(`^(\*|[A-Za-z]{1,8}(-[A-Za-z0-9]{1,8})*)$`)
+	qualityRe         = regexp.MustCompile(`^[qQ]=(0(\.\d{0,3})?|1(\.0{0,3})?)$`)
+)
+
+func parseUserAgent(ua string) browser {
+	if m := chromiumVersionRe.FindStringSubmatch(ua); m != nil && strings.HasPrefix(ua, "Mozilla/5.0") {
+		version, _ := strconv.Atoi(m[1])
+		return browser{chromium: true, version: version}
+	}
+	if m := firefoxVersionRe.FindStringSubmatch(ua); m != nil && strings.HasPrefix(ua, "Mozilla/5.0") {
+		version, _ := strconv.Atoi(m[1])
+		return browser{firefox: true, version: version}
+	}
+	if m := safariVersionRe.FindStringSubmatch(ua); m != nil && strings.HasPrefix(ua, "Mozilla/5.0") {
+		// Safari versions are scaled by 100 to tell 16.4 from 16.0.
+		major, _ := strconv.Atoi(m[1])
+		minor, _ := strconv.Atoi(m[2])
+		return browser{safari: true, version: major*100 + minor}
+	}
+	return browser{}
+}
+
+// sendsFetchMetadata reports whether the browser sends Sec-Fetch-* headers to secure origins.
+func (b browser) sendsFetchMetadata() bool {
+	return b.chromium && b.version >= 80 || b.firefox && b.version >= 90 || b.safari && b.version >= 1604
+}
+
+// isSecure reports whether the request was received over TLS. Browsers only send client hints and fetch metadata to
+// secure origins.
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil
+}
+
+// validAcceptLanguage reports whether the header is a well-formed list of language ranges.
+func validAcceptLanguage(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !languageRangeRe.MatchString(strings.TrimSpace(tag)) {
+			return false
+		}
+		if params != "" && !qualityRe.MatchString(strings.TrimSpace(params)) {
+			return false
+		}
+	}
+	return true
+}
+
+// platformTokens maps the values of Sec-CH-UA-Platform to the tokens that the User-Agent of the platform contains.
+var platformTokens = map[string]string{
+	`"Windows"`:   "Windows",
+	`"macOS"`:     "Macintosh",
+	`"Linux"`:     "Linux",
+	`"Android"`:   "Android",
+	`"Chrome OS"`: "CrOS",
+}
+
+type check struct {
+	name   string
+	weight int
+	fails  func(r *http.Request, client browser) bool
+}
+
+// checks are the request consistency checks with their default weights.
+//
+// The order of headers would be another strong signal, but net/http doesn't preserve it.
+var checks = []check{
+	{
+		name:   "automation_user_agent",
+		weight: 30,
+		fails: func(r *http.Request, _ browser) bool {
+			ua := r.Header.Get("User-Agent")
+			return ua == "" || automationRe.MatchString(ua)
+		},
+	},
+	{
+		name:   "missing_client_hints",
+		weight: 20,
+		fails: func(r *http.Request, client browser) bool {
+			// Chromium sends client hints since version 89.
+			return client.chromium && client.version >= 89 && isSecure(r) && r.Header.Get("Sec-CH-UA") == ""
+		},
+	},
+	{
+		name:   "client_hints_mismatch",
+		weight: 30,
+		fails: func(r *http.Request, client browser) bool {
+			if r.Header.Get("Sec-CH-UA") == "" {
+				return false
+			}
+			if !client.chromium {
+				return true
+			}
+			token, ok := platformTokens[r.Header.Get("Sec-CH-UA-Platform")]
+			return ok && !strings.Contains(r.Header.Get("User-Agent"), token)
+		},
+	},
+	{
+		name:   "missing_fetch_metadata",
+		weight: 20,
+		fails: func(r *http.Request, client browser) bool {
+			return client.sendsFetchMetadata() && isSecure(r) && r.Header.Get("Sec-Fetch-Mode") == ""
+		},
+	},
+	{
+		name:   "http1_browser",
+		weight: 10,
+		fails: func(r *http.Request, client browser) bool {
+			// Browsers negotiate HTTP/2 or later over TLS if the server supports it.
+			return client.isBrowser() && isSecure(r) && r.ProtoMajor < 2
+		},
+	},
+	{
+		name:   "missing_accept_language",
+		weight: 10,
+		fails: func(r *http.Request, client browser) bool {
+			return client.isBrowser() && r.Header.Get("Accept-Language") == ""
+		},
+	},
+	{
+		name:   "invalid_accept_language",
+		weight: 10,
+		fails: func(r *http.Request, _ browser) bool {
+			header := r.Header.Get("Accept-Language")
+			return header != "" && !validAcceptLanguage(header)
+		},
+	},
+	{
+		name:   "missing_accept_encoding",
+		weight: 10,
+		fails: func(r *http.Request, client browser) bool {
+			return client.isBrowser() && !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+		},
+	},
+}
+
+func findCheck(name string) (check, bool) {
+	for _, check := range checks {
+		if check.name == name {
+			return check, true
+		}
+	}
+	return check{}, false
+}
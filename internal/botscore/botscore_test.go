@@ -0,0 +1,196 @@
+package botscore
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+const (
+	chromeUA  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/141.0.0.0 Safari/537.36"
+	firefoxUA = "Mozilla/5.0 (X11; Linux x86_64; rv:143.0) Gecko/20100101 Firefox/143.0"
+	safariUA  = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/18.6 Safari/605.1.15"
+)
+
+func newRequest(headers map[string]string, http2 bool) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	r.TLS = &tls.ConnectionState{}
+	if http2 {
+		r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/2.0", 2, 0
+	}
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	return r
+}
+
+func TestScore(t *testing.T) {
+	chrome := map[string]string{
+		"User-Agent":         chromeUA,
+		"Sec-CH-UA":          `"Google Chrome";v="141", "Not?A_Brand";v="8", "Chromium";v="141"`,
+		"Sec-CH-UA-Platform": `"Windows"`,
+		"Sec-Fetch-Mode":     "navigate",
+		"Accept-Language":    "en-US,en;q=0.9,zh-CN;q=0.8",
+		"Accept-Encoding":    "gzip, deflate, br, zstd",
+	}
+	with := func(base map[string]string, key, value string) map[string]string {
+		headers := make(map[string]string, len(base))
+		for k, v := range base {
+			headers[k] = v
+		}
+		if value == "" {
+			delete(headers, key)
+		} else {
+			headers[key] = value
+		}
+		return headers
+	}
+
+	tests := []struct {
+		name     string
+		request  *http.Request
+		expected []string
+	}{
+		{
+			name:     "chrome",
+			request:  newRequest(chrome, true),
+			expected: nil,
+		},
+		{
+			name: "firefox",
+			request: newRequest(map[string]string{
+				"User-Agent":      firefoxUA,
+				"Sec-Fetch-Mode":  "navigate",
+				"Accept-Language": "zh-CN,zh;q=0.8,en-US;q=0.5,en;q=0.3",
+				"Accept-Encoding": "gzip, deflate, br, zstd",
+			}, true),
+			expected: nil,
+		},
+		{
+			name: "safari",
+			request: newRequest(map[string]string{
+				"User-Agent":      safariUA,
+				"Sec-Fetch-Mode":  "navigate",
+				"Accept-Language": "en-GB,en;q=0.9",
+				"Accept-Encoding": "gzip, deflate, br",
+			}, true),
+			expected: nil,
+		},
+		{
+			name:     "chrome without client hints",
+			request:  newRequest(with(chrome, "Sec-CH-UA", ""), true),
+			expected: []string{"missing_client_hints"},
+		},
+		{
+			name:     "chrome on the wrong platform",
+			request:  newRequest(with(chrome, "Sec-CH-UA-Platform", `"macOS"`), true),
+			expected: []string{"client_hints_mismatch"},
+		},
+		{
+			name:     "client hints from firefox",
+			request:  newRequest(with(chrome, "User-Agent", firefoxUA), true),
+			expected: []string{"client_hints_mismatch"},
+		},
+		{
+			name:     "chrome without fetch metadata over HTTP/1.1",
+			request:  newRequest(with(chrome, "Sec-Fetch-Mode", ""), false),
+			expected: []string{"missing_fetch_metadata", "http1_browser"},
+		},
+		{
+			name:     "chrome with a malformed Accept-Language",
+			request:  newRequest(with(chrome, "Accept-Language", "en-US;q=2,@@"), true),
+			expected: []string{"invalid_accept_language"},
+		},
+		{
+			name:     "chrome without Accept-Language and Accept-Encoding",
+			request:  newRequest(with(with(chrome, "Accept-Language", ""), "Accept-Encoding", ""), true),
+			expected: []string{"missing_accept_language", "missing_accept_encoding"},
+		},
+		{
+			name:     "curl",
+			request:  newRequest(map[string]string{"User-Agent": "curl/8.5.0"}, false),
+			expected: []string{"automation_user_agent"},
+		},
+		{
+			name:     "headless chrome",
+			request:  newRequest(with(chrome, "User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) HeadlessChrome/141.0.0.0 Safari/537.36"), true),
+			expected: []string{"automation_user_agent", "client_hints_mismatch"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			score, failed := Config{}.Score(tt.request)
+			if !slices.Equal(failed, tt.expected) {
+				t.Errorf("expected failed checks %v, got %v", tt.expected, failed)
+			}
+
+			expectedScore := 0
+			for _, name := range tt.expected {
+				check, _ := findCheck(name)
+				expectedScore += check.weight
+			}
+			if score != expectedScore {
+				t.Errorf("expected score %d, got %d", expectedScore, score)
+			}
+		})
+	}
+}
+
+func TestWeights(t *testing.T) {
+	r := newRequest(map[string]string{"User-Agent": "curl/8.5.0"}, false)
+
+	score, failed := Config{Weights: map[string]int{"automation_user_agent": 0}}.Score(r)
+	if score != 0 || len(failed) != 0 {
+		t.Errorf("expected disabled check not to count, got score %d from %v", score, failed)
+	}
+
+	score, _ = Config{Weights: map[string]int{"automation_user_agent": 100}}.Score(r)
+	if score != 100 {
+		t.Errorf("expected overridden weight to count, got score %d", score)
+	}
+}
+
+func TestDecide(t *testing.T) {
+	if action := (Config{}).Decide(100); action != Challenge {
+		t.Errorf("expected every request to be challenged without thresholds, got %s", action)
+	}
+
+	c := Config{ChallengeThreshold: 10, HarderThreshold: 30, BlockThreshold: 60}
+	tests := []struct {
+		score    int
+		expected Action
+	}{
+		{score: 0, expected: Allow},
+		{score: 10, expected: Challenge},
+		{score: 30, expected: Harder},
+		{score: 59, expected: Harder},
+		{score: 60, expected: Block},
+	}
+	for _, tt := range tests {
+		if action := c.Decide(tt.score); action != tt.expected {
+			t.Errorf("score %d: expected %s, got %s", tt.score, tt.expected, action)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   Config
+		valid bool
+	}{
+		{name: "empty", cfg: Config{}, valid: true},
+		{name: "thresholds", cfg: Config{ChallengeThreshold: 10, HarderThreshold: 30, BlockThreshold: 60}, valid: true},
+		{name: "unknown check", cfg: Config{Weights: map[string]int{"header_order": 10}}, valid: false},
+		{name: "negative weight", cfg: Config{Weights: map[string]int{"http1_browser": -10}}, valid: false},
+		{name: "block below challenge", cfg: Config{ChallengeThreshold: 30, BlockThreshold: 10}, valid: false},
+	}
+	for _, tt := range tests {
+		if err := ValidateConfig(tt.cfg); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid to be %v, got error %v", tt.name, tt.valid, err)
+		}
+	}
+}
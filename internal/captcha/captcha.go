@@ -0,0 +1,158 @@
+package captcha
+
+import (
+	crand "crypto/rand"
+	"image"
+	"image/color"
+	"math"
+	"math/rand/v2"
+)
+
+const (
+	// Alphabet is the set of characters used in answers. Easily confused characters are left out.
+	Alphabet = "ACDEFHJKLMNPRTUVWXY34679"
+
+	Width  = 240
+	Height = 80
+
+	glyphWidth  = 5
+	glyphHeight = 7
+)
+
+// glyphs is a 5x7 bitmap font covering Alphabet.
+var glyphs = map[byte][glyphHeight]string{
+	'A': {".###.", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'C': {".####", "#....", "#....", "#....", "#....", "#....", ".####"},
+	'D': {"####.", "#...#", "#...#", "#...#", "#...#", "#...#", "####."},
+	'E': {"#####", "#....", "#....", "####.", "#....", "#....", "#####"},
+	'F': {"#####", "#....", "#....", "####.", "#....", "#....", "#...."},
+	'H': {"#...#", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'J': {"..###", "...#.", "...#.", "...#.", "...#.", "#..#.", ".##.."},
+	'K': {"#...#", "#..#.", "#.#..", "##...", "#.#..", "#..#.", "#...#"},
+	'L': {"#....", "#....", "#....", "#....", "#....", "#....", "#####"},
+	'M': {"#...#", "##.##", "#.#.#", "#.#.#", "#...#", "#...#", "#...#"},
+	'N': {"#...#", "##..#", "#.#.#", "#..##", "#...#", "#...#", "#...#"},
+	'P': {"####.", "#...#", "#...#", "####.", "#....", "#....", "#...."},
+	'R': {"####.", "#...#", "#...#", "####.", "#.#..", "#..#.", "#...#"},
+	'T': {"#####", "..#..", "..#..", "..#..", "..#..", "..#..", "..#.."},
+	'U': {"#...#", "#...#", "#...#", "#...#", "#...#", "#...#", ".###."},
+	'V': {"#...#", "#...#", "#...#", "#...#", "#...#", ".#.#.", "..#.."},
+	'W': {"#...#", "#...#", "#...#", "#.#.#", "#.#.#", "##.##", "#...#"},
+	'X': {"#...#", "#...#", ".#.#.", "..#..", ".#.#.", "#...#", "#...#"},
+	'Y': {"#...#", "#...#", ".#.#.", "..#..", "..#..", "..#..", "..#.."},
+	'3': {"####.", "....#", "....#", ".###.", "....#", "....#", "####."},
+	'4': {"...#.", "..##.", ".#.#.", "#..#.", "#####", "...#.", "...#."},
+	'6': {".###.", "#....", "#....", "####.", "#...#", "#...#", ".###."},
+	'7': {"#####", "....#", "...#.", "..#..", ".#...", ".#...", ".#..."},
+	'9': {".###.", "#...#", "#...#", ".####", "....#", "....#", ".###."},
+}
+
+var palette = color.Palette{
+	color.RGBA{0xff, 0xf8, 0xe7, 0xff}, // background
+	color.RGBA{0x3b, 0x2f, 0x4f, 0xff},
+	color.RGBA{0x5a, 0x3e, 0x7a, 0xff},
+	color.RGBA{0x2f, 0x4f, 0x4f, 0xff},
+	color.RGBA{0x7a, 0x4a, 0x2a, 0xff},
+}
+
+// colorBackground is the index of the background in palette. The other colors are used for both text and noise, so
+// that the noise can't be told apart from the text by its color.
+const colorBackground uint8 = 0
+
+// Generate returns a random answer of the given length and a distorted image of it.
+func Generate(length int) (string, *image.Paletted) {
+	var seed [32]byte
+	_, _ = crand.Read(seed[:])                               // never returns an error
+	return generate(rand.New(rand.NewChaCha8(seed)), length) // #nosec G404 -- seeded from crypto/rand
+}
+
+func generate(rng *rand.Rand, length int) (string, *image.Paletted) {
+	answer := make([]byte, length)
+	for i := range answer {
+		answer[i] = Alphabet[rng.IntN(len(Alphabet))]
+	}
+
+	// Draw the glyphs with random scale, shear, offset and color onto a canvas.
+	canvas := image.NewPaletted(image.Rect(0, 0, Width, Height), palette)
+	cellWidth := Width / (length + 1)
+	for i, ch := range answer {
+		scale := 5 + rng.IntN(2)
+		shear := rng.Float64()*0.5 - 0.25
+		x0 := cellWidth/2 + i*cellWidth + rng.IntN(7) - 3
+		y0 := (Height-glyphHeight*scale)/2 + rng.IntN(11) - 5
+		c := inkColor(rng)
+
+		for row, line := range glyphs[ch] {
+			for col := range glyphWidth {
+				if line[col] != '#' {
+					continue
+				}
+				dx := int(shear * float64((glyphHeight/2-row)*scale))
+				fillRect(canvas, x0+col*scale+dx, y0+row*scale, scale, scale, c)
+			}
+		}
+	}
+
+	// Warp the canvas with random sine waves along both axes.
+	img := image.NewPaletted(canvas.Rect, palette)
+	ampX, ampY := 1+rng.Float64()*2, 2+rng.Float64()*2
+	periodX, periodY := 50+rng.Float64()*30, 80+rng.Float64()*80
+	phaseX, phaseY := rng.Float64()*2*math.Pi, rng.Float64()*2*math.Pi
+	for y := range Height {
+		for x := range Width {
+			sx := x + int(ampX*math.Sin(2*math.Pi*float64(y)/periodX+phaseX))
+			sy := y + int(ampY*math.Sin(2*math.Pi*float64(x)/periodY+phaseY))
+			if image.Pt(sx, sy).In(canvas.Rect) {
+				img.SetColorIndex(x, y, canvas.ColorIndexAt(sx, sy))
+			}
+		}
+	}
+
+	addNoise(rng, img)
+
+	return string(answer), img
+}
+
+// inkColor returns a random palette index of the colors used for text.
+func inkColor(rng *rand.Rand) uint8 {
+	return colorBackground + 1 + uint8(rng.IntN(len(palette)-1)) // #nosec G115 -- small palette
+}
+
+// addNoise draws lines and dots in the text colors, and punches dots of the background color into the text.
+func addNoise(rng *rand.Rand, img *image.Paletted) {
+	for range 4 {
+		drawLine(img, rng.IntN(Width/4), rng.IntN(Height), Width-1-rng.IntN(Width/4), rng.IntN(Height), inkColor(rng))
+	}
+	for range Width * Height / 60 {
+		img.SetColorIndex(rng.IntN(Width), rng.IntN(Height), inkColor(rng))
+	}
+	for range Width * Height / 60 {
+		img.SetColorIndex(rng.IntN(Width), rng.IntN(Height), colorBackground)
+	}
+}
+
+func fillRect(img *image.Paletted, x, y, w, h int, c uint8) {
+	for j := y; j < y+h; j++ {
+		for i := x; i < x+w; i++ {
+			if image.Pt(i, j).In(img.Rect) {
+				img.SetColorIndex(i, j, c)
+			}
+		}
+	}
+}
+
+func drawLine(img *image.Paletted, x0, y0, x1, y1 int, c uint8) {
+	steps := max(abs(x1-x0), abs(y1-y0))
+	for s := 0; s <= steps; s++ {
+		x := x0 + (x1-x0)*s/steps
+		y := y0 + (y1-y0)*s/steps
+		fillRect(img, x, y, 2, 2, c)
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,70 @@
+package captcha
+
+import (
+	"image"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+func TestGlyphs(t *testing.T) {
+	for i := range len(Alphabet) {
+		glyph, ok := glyphs[Alphabet[i]]
+		if !ok {
+			t.Fatalf("missing glyph for %q", Alphabet[i])
+		}
+		for _, line := range glyph {
+			if len(line) != glyphWidth {
+				t.Fatalf("glyph for %q has a line of width %d", Alphabet[i], len(line))
+			}
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	for range 16 {
+		answer, img := generate(rng, 6)
+
+		if len(answer) != 6 {
+			t.Fatalf("expected answer of length 6, got %q", answer)
+		}
+		for _, ch := range answer {
+			if !strings.ContainsRune(Alphabet, ch) {
+				t.Fatalf("unexpected character %q in answer %q", ch, answer)
+			}
+		}
+
+		if img.Rect.Dx() != Width || img.Rect.Dy() != Height {
+			t.Fatalf("unexpected image size %v", img.Rect)
+		}
+
+		text := 0
+		for _, c := range img.Pix {
+			if c != colorBackground {
+				text++
+			}
+		}
+		if text < len(answer)*glyphWidth*glyphHeight {
+			t.Fatalf("expected the glyphs to be drawn, got %d text pixels", text)
+		}
+	}
+}
+
+func TestNoiseColors(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	img := image.NewPaletted(image.Rect(0, 0, Width, Height), palette)
+	addNoise(rng, img)
+
+	// The noise must use every text color, so that removing a single color doesn't leave clean glyphs.
+	used := make([]bool, len(palette))
+	for _, c := range img.Pix {
+		used[c] = true
+	}
+	for i := range palette {
+		if !used[i] {
+			t.Errorf("noise doesn't use color %d", i)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Package policy evaluates rules written in CEL (https://cel.dev) to decide what to do with a request.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+)
+
+// Action is what to do with a request that matches a rule.
+type Action string
+
+const (
+	// Allow lets the request through without a challenge.
+	Allow Action = "allow"
+	// Challenge asks the client to solve a challenge, optionally with a different difficulty.
+	Challenge Action = "challenge"
+	// Block rejects the request, and optionally blocks the IP block of the client for a while.
+	Block Action = "block"
+)
+
+// Rule is a CEL expression and the action to take on requests for which it's true.
+type Rule struct {
+	// Expression is a CEL expression that evaluates to a boolean.
+	Expression string `json:"expression"`
+	// Action is "allow", "challenge" or "block".
+	Action Action `json:"action"`
+	// DifficultyBits is the difficulty of the challenge for the "challenge" action. Zero keeps the usual difficulty.
+	DifficultyBits int `json:"difficulty_bits,omitempty"`
+	// BlockTTL is how long the IP block of the client stays blocked for the "block" action.
+	// Zero only rejects the matching request.
+	BlockTTL time.Duration `json:"block_ttl,omitempty"`
+}
+
+// Input is what rules know about a request besides the request itself.
+type Input struct {
+	ClientIP string
+	// IPBlock is the IP block of the client in CIDR notation, e.g. "192.0.2.0/24".
+	IPBlock string
+	// Pending is the number of pending challenges of the IP block.
+	Pending int32
+	// BotScore is the bot score of the request, and BotChecks are the checks that added to it.
+	BotScore  int
+	BotChecks []string
+	// JA4 and JA3 are the TLS fingerprints of the client, or empty if they're unknown.
+	JA4 string
+	JA3 string
+}
+
+// Policy is a list of compiled rules. The first rule that matches a request wins.
+type Policy struct {
+	rules    []Rule
+	programs []cel.Program
+}
+
+// newEnv declares the variables that rules can use.
+func newEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		ext.Strings(),
+		cel.Variable("method", cel.StringType),
+		cel.Variable("host", cel.StringType),
+		cel.Variable("path", cel.StringType),
+		cel.Variable("query", cel.StringType),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("client_ip", cel.StringType),
+		cel.Variable("ip_block", cel.StringType),
+		cel.Variable("pending", cel.IntType),
+		cel.Variable("bot_score", cel.IntType),
+		cel.Variable("bot_checks", cel.ListType(cel.StringType)),
+		cel.Variable("ja4", cel.StringType),
+		cel.Variable("ja3", cel.StringType),
+	)
+}
+
+// Compile type-checks the rules, so that invalid rules are reported before any request is served.
+func Compile(rules []Rule) (*Policy, error) {
+	env, err := newEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{rules: rules, programs: make([]cel.Program, len(rules))}
+	for i, rule := range rules {
+		switch rule.Action {
+		case Allow, Challenge, Block:
+		default:
+			return nil, fmt.Errorf("rule %d: unknown action %q", i, rule.Action)
+		}
+		if rule.DifficultyBits != 0 && rule.Action != Challenge {
+			return nil, fmt.Errorf("rule %d: difficulty_bits only applies to the challenge action", i)
+		}
+		if rule.BlockTTL < 0 {
+			return nil, fmt.Errorf("rule %d: block_ttl must be a positive duration", i)
+		}
+		if rule.BlockTTL != 0 && rule.Action != Block {
+			return nil, fmt.Errorf("rule %d: block_ttl only applies to the block action", i)
+		}
+
+		ast, issues := env.Compile(rule.Expression)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, issues.Err())
+		}
+		if ast.OutputType() != cel.BoolType {
+			return nil, fmt.Errorf("rule %d: expression must evaluate to a bool, not %s", i, ast.OutputType())
+		}
+		p.programs[i], err = env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+
+	return p, nil
+}
+
+// Rules returns the rules of the policy.
+func (p *Policy) Rules() []Rule {
+	return p.rules
+}
+
+// activation returns the values of the variables for the request.
+func activation(r *http.Request, in Input) map[string]any {
+	// Multiple values of a header are joined as if they were sent in a single header.
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		headers[name] = strings.Join(values, ", ")
+	}
+	botChecks := in.BotChecks
+	if botChecks == nil {
+		botChecks = []string{}
+	}
+
+	return map[string]any{
+		"method":     r.Method,
+		"host":       r.Host,
+		"path":       r.URL.Path,
+		"query":      r.URL.RawQuery,
+		"headers":    headers,
+		"client_ip":  in.ClientIP,
+		"ip_block":   in.IPBlock,
+		"pending":    int64(in.Pending),
+		"bot_score":  int64(in.BotScore),
+		"bot_checks": botChecks,
+		"ja4":        in.JA4,
+		"ja3":        in.JA3,
+	}
+}
+
+// Evaluate returns the first rule that matches the request, or nil if there's none.
+// Rules that fail to evaluate, e.g. on a missing header, don't match, and their errors are returned along with the result.
+func (p *Policy) Evaluate(r *http.Request, in Input) (*Rule, error) {
+	vars := activation(r, in)
+
+	var errs []error
+	for i, program := range p.programs {
+		out, _, err := program.Eval(vars)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule %d: %w", i, err))
+			continue
+		}
+		if matched, ok := out.Value().(bool); ok && matched {
+			return &p.rules[i], errors.Join(errs...)
+		}
+	}
+	return nil, errors.Join(errs...)
+}
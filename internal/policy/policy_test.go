@@ -0,0 +1,95 @@
+package policy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		valid bool
+	}{
+		{name: "empty", rules: nil, valid: true},
+		{
+			name: "all actions",
+			rules: []Rule{
+				{Expression: `path.startsWith("/static/")`, Action: Allow},
+				{Expression: `bot_score >= 30 || "automation_user_agent" in bot_checks`, Action: Challenge, DifficultyBits: 12},
+				{Expression: `pending > 64`, Action: Block, BlockTTL: time.Hour},
+			},
+			valid: true,
+		},
+		{name: "syntax error", rules: []Rule{{Expression: `path ==`, Action: Allow}}, valid: false},
+		{name: "unknown variable", rules: []Rule{{Expression: `user == "root"`, Action: Allow}}, valid: false},
+		{name: "not a bool", rules: []Rule{{Expression: `path`, Action: Allow}}, valid: false},
+		{name: "type mismatch", rules: []Rule{{Expression: `pending > "64"`, Action: Allow}}, valid: false},
+		{name: "unknown action", rules: []Rule{{Expression: `true`, Action: "deny"}}, valid: false},
+		{name: "difficulty without challenge", rules: []Rule{{Expression: `true`, Action: Allow, DifficultyBits: 8}}, valid: false},
+		{name: "ttl without block", rules: []Rule{{Expression: `true`, Action: Challenge, BlockTTL: time.Hour}}, valid: false},
+	}
+
+	for _, tt := range tests {
+		if _, err := Compile(tt.rules); (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid to be %v, got error %v", tt.name, tt.valid, err)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	p, err := Compile([]Rule{
+		{Expression: `headers["X-Api-Key"] == "secret"`, Action: Allow},
+		{Expression: `method == "GET" && path.startsWith("/static/")`, Action: Allow},
+		{Expression: `pending > 8 || ja4 == "t13d1516h2_8daaf6152771_e5627efa2ab1"`, Action: Block, BlockTTL: time.Hour},
+		{Expression: `ip_block == "192.0.2.0/24" && query.contains("download")`, Action: Challenge, DifficultyBits: 20},
+		{Expression: `bot_score >= 30`, Action: Challenge, DifficultyBits: 16},
+	})
+	if err != nil {
+		t.Fatalf("failed to compile policy: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		headers  map[string]string
+		input    Input
+		expected int
+		errors   bool
+	}{
+		{name: "no match", target: "/", expected: -1, errors: true},
+		{name: "header", target: "/", headers: map[string]string{"X-Api-Key": "secret"}, expected: 0},
+		{name: "path", target: "/static/app.js", expected: 1, errors: true},
+		{name: "pending", target: "/", input: Input{Pending: 9}, expected: 2, errors: true},
+		{name: "fingerprint", target: "/", input: Input{JA4: "t13d1516h2_8daaf6152771_e5627efa2ab1"}, expected: 2, errors: true},
+		{name: "ip block", target: "/?download=1", input: Input{IPBlock: "192.0.2.0/24"}, expected: 3, errors: true},
+		{name: "first match wins", target: "/?download=1", input: Input{IPBlock: "192.0.2.0/24", BotScore: 40}, expected: 3, errors: true},
+		{name: "bot score", target: "/", input: Input{BotScore: 40, BotChecks: []string{"http1_browser"}}, expected: 4, errors: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+
+			rule, err := p.Evaluate(r, tt.input)
+			// The first rule fails to evaluate on requests without the header, which doesn't stop the others.
+			if (err != nil) != tt.errors {
+				t.Errorf("expected errors to be %v, got %v", tt.errors, err)
+			}
+			if tt.expected < 0 {
+				if rule != nil {
+					t.Errorf("expected no match, got %+v", *rule)
+				}
+				return
+			}
+			if rule != &p.Rules()[tt.expected] {
+				t.Errorf("expected rule %d to match, got %+v", tt.expected, rule)
+			}
+		})
+	}
+}
@@ -17,11 +17,12 @@ var (
 	poolPos = poolSize
 )
 
-func ReadUint32() uint32 {
+// Read fills b with random bytes. b must not be larger than the pool.
+func Read(b []byte) {
 	poolMu.Lock()
 	defer poolMu.Unlock()
 
-	if poolPos == poolSize {
+	if poolPos+len(b) > poolSize {
 		_, err := io.ReadFull(rand.Reader, pool[:])
 		if err != nil {
 			panic(err)
@@ -29,7 +30,11 @@ func ReadUint32() uint32 {
 		poolPos = 0
 	}
 
-	poolPos += 4
+	poolPos += copy(b, pool[poolPos:])
+}
 
-	return binary.BigEndian.Uint32(pool[poolPos-4 : poolPos])
+func ReadUint32() uint32 {
+	var buf [4]byte
+	Read(buf[:])
+	return binary.BigEndian.Uint32(buf[:])
 }
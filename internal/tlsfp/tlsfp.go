@@ -0,0 +1,400 @@
+// Package tlsfp computes JA3 and JA4 fingerprints of TLS client hellos as they are read from a connection.
+package tlsfp
+
+import (
+	"crypto/md5" // #nosec G501 -- JA3 is defined as an MD5 hash
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+	recordHeaderLen          = 5
+	handshakeHeaderLen       = 4
+	// maxHelloLen is the size limit of a client hello, which may span multiple records.
+	maxHelloLen = 1 << 16
+
+	extServerName          = 0x0000
+	extSupportedGroups     = 0x000a
+	extECPointFormats      = 0x000b
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSupportedVersions   = 0x002b
+)
+
+var errMalformed = errors.New("malformed client hello")
+
+// ClientHello holds the fields of a TLS client hello that make up its fingerprints.
+type ClientHello struct {
+	Version             uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	ECPointFormats      []uint8
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
+	ALPN                []string
+	HasServerName       bool
+}
+
+// Fingerprint is the fingerprint of a TLS client hello.
+type Fingerprint struct {
+	// JA3 is the MD5 hash of the JA3 string.
+	JA3 string
+	// JA4 is the JA4 fingerprint, e.g. "t13d1516h2_8daaf6152771_e5627efa2ab1".
+	JA4 string
+}
+
+// isGREASE reports whether v is a GREASE value (RFC 8701), which clients add at random and fingerprints ignore.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	return slices.DeleteFunc(slices.Clone(values), isGREASE)
+}
+
+// ParseClientHello parses a client hello handshake message, including its handshake header.
+func ParseClientHello(msg []byte) (*ClientHello, error) {
+	s := cryptobyte.String(msg)
+
+	var msgType uint8
+	var body cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != handshakeTypeClientHello || !s.ReadUint24LengthPrefixed(&body) {
+		return nil, errMalformed
+	}
+
+	hello := &ClientHello{}
+	var sessionID, ciphers, compression cryptobyte.String
+	if !body.ReadUint16(&hello.Version) ||
+		!body.Skip(32) || // random
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&ciphers) ||
+		!body.ReadUint8LengthPrefixed(&compression) {
+		return nil, errMalformed
+	}
+
+	for !ciphers.Empty() {
+		var cipher uint16
+		if !ciphers.ReadUint16(&cipher) {
+			return nil, errMalformed
+		}
+		hello.CipherSuites = append(hello.CipherSuites, cipher)
+	}
+
+	if body.Empty() {
+		return hello, nil // no extensions
+	}
+
+	var extensions cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errMalformed
+	}
+	for !extensions.Empty() {
+		var extType uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errMalformed
+		}
+		hello.Extensions = append(hello.Extensions, extType)
+
+		var ok bool
+		switch extType {
+		case extServerName:
+			hello.HasServerName, ok = true, true
+		case extSupportedGroups:
+			hello.SupportedGroups, ok = readUint16List(&data)
+		case extECPointFormats:
+			var formats cryptobyte.String
+			ok = data.ReadUint8LengthPrefixed(&formats)
+			hello.ECPointFormats = formats
+		case extSignatureAlgorithms:
+			hello.SignatureAlgorithms, ok = readUint16List(&data)
+		case extALPN:
+			hello.ALPN, ok = readALPN(&data)
+		case extSupportedVersions:
+			var versions cryptobyte.String
+			ok = data.ReadUint8LengthPrefixed(&versions)
+			for ok && !versions.Empty() {
+				var version uint16
+				ok = versions.ReadUint16(&version)
+				hello.SupportedVersions = append(hello.SupportedVersions, version)
+			}
+		default:
+			ok = true
+		}
+		if !ok {
+			return nil, errMalformed
+		}
+	}
+
+	return hello, nil
+}
+
+func readUint16List(s *cryptobyte.String) ([]uint16, bool) {
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) {
+		return nil, false
+	}
+	var values []uint16
+	for !list.Empty() {
+		var v uint16
+		if !list.ReadUint16(&v) {
+			return nil, false
+		}
+		values = append(values, v)
+	}
+	return values, true
+}
+
+func readALPN(s *cryptobyte.String) ([]string, bool) {
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) {
+		return nil, false
+	}
+	var protocols []string
+	for !list.Empty() {
+		var proto cryptobyte.String
+		if !list.ReadUint8LengthPrefixed(&proto) {
+			return nil, false
+		}
+		protocols = append(protocols, string(proto))
+	}
+	return protocols, true
+}
+
+func joinDecimal[T uint8 | uint16](values []T) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// JA3 returns the JA3 string of the client hello: the version, cipher suites, extensions, supported groups and
+// point formats, without GREASE values.
+func (h *ClientHello) JA3() string {
+	return fmt.Sprintf("%d,%s,%s,%s,%s",
+		h.Version,
+		joinDecimal(withoutGREASE(h.CipherSuites)),
+		joinDecimal(withoutGREASE(h.Extensions)),
+		joinDecimal(withoutGREASE(h.SupportedGroups)),
+		joinDecimal(h.ECPointFormats),
+	)
+}
+
+// ja4Version returns the JA4 code of the highest TLS version that the client supports.
+func (h *ClientHello) ja4Version() string {
+	version := h.Version
+	if versions := withoutGREASE(h.SupportedVersions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the first and last characters of the first ALPN protocol, or of its hex encoding if they aren't
+// alphanumeric.
+func (h *ClientHello) ja4ALPN() string {
+	if len(h.ALPN) == 0 || h.ALPN[0] == "" {
+		return "00"
+	}
+
+	isAlnum := func(b byte) bool {
+		return '0' <= b && b <= '9' || 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z'
+	}
+
+	proto := h.ALPN[0]
+	if !isAlnum(proto[0]) || !isAlnum(proto[len(proto)-1]) {
+		proto = hex.EncodeToString([]byte(proto))
+	}
+	return proto[:1] + proto[len(proto)-1:]
+}
+
+// ja4Hash returns the truncated SHA-256 hash of a JA4 part, or zeros if the part is empty.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:6])
+}
+
+// JA4 returns the JA4 fingerprint of the client hello, received over TCP.
+func (h *ClientHello) JA4() string {
+	ciphers := withoutGREASE(h.CipherSuites)
+	extensions := withoutGREASE(h.Extensions)
+
+	sni := "i"
+	if h.HasServerName {
+		sni = "d"
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", h.ja4Version(), sni, min(len(ciphers), 99), min(len(extensions), 99), h.ja4ALPN())
+
+	slices.Sort(ciphers)
+	b := ja4Hash(joinHex(ciphers))
+
+	// The server name and ALPN are already part of a, and vary with the site rather than the client.
+	extensions = slices.DeleteFunc(extensions, func(ext uint16) bool {
+		return ext == extServerName || ext == extALPN
+	})
+	slices.Sort(extensions)
+	c := ""
+	if len(extensions) > 0 {
+		c = joinHex(extensions)
+		if len(h.SignatureAlgorithms) > 0 {
+			c += "_" + joinHex(h.SignatureAlgorithms)
+		}
+	}
+
+	return a + "_" + b + "_" + ja4Hash(c)
+}
+
+// Fingerprint returns the JA3 and JA4 fingerprints of the client hello.
+func (h *ClientHello) Fingerprint() Fingerprint {
+	ja3 := md5.Sum([]byte(h.JA3())) // #nosec G401 -- JA3 is defined as an MD5 hash
+	return Fingerprint{
+		JA3: hex.EncodeToString(ja3[:]),
+		JA4: h.JA4(),
+	}
+}
+
+// readHandshake reassembles the first handshake message from the TLS records in buf.
+// It returns nil without an error if more data is needed.
+func readHandshake(buf []byte) ([]byte, error) {
+	var msg []byte
+	for len(buf) >= recordHeaderLen {
+		if buf[0] != recordTypeHandshake {
+			return nil, errors.New("not a TLS handshake")
+		}
+		recordLen := int(buf[3])<<8 | int(buf[4])
+		if len(buf) < recordHeaderLen+recordLen {
+			return nil, nil
+		}
+		msg = append(msg, buf[recordHeaderLen:recordHeaderLen+recordLen]...)
+		buf = buf[recordHeaderLen+recordLen:]
+
+		if len(msg) >= handshakeHeaderLen {
+			msgLen := handshakeHeaderLen + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if msgLen > maxHelloLen {
+				return nil, errors.New("client hello too large")
+			}
+			if len(msg) >= msgLen {
+				return msg[:msgLen], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// Conn is a connection that fingerprints the TLS client hello read through it.
+type Conn struct {
+	net.Conn
+
+	mu   sync.Mutex
+	buf  []byte
+	done bool
+	fp   Fingerprint
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.record(b[:n])
+	}
+	return n, err
+}
+
+// record collects the bytes of the client hello until it can be fingerprinted.
+func (c *Conn) record(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.done {
+		return
+	}
+
+	c.buf = append(c.buf, b...)
+	msg, err := readHandshake(c.buf)
+	if err == nil && msg == nil && len(c.buf) <= maxHelloLen {
+		return // more data is needed
+	}
+
+	// Connections that don't start with a client hello are left without a fingerprint.
+	c.done = true
+	c.buf = nil
+	if err != nil || msg == nil {
+		return
+	}
+	if hello, err := ParseClientHello(msg); err == nil {
+		c.fp = hello.Fingerprint()
+	}
+}
+
+// Fingerprint returns the fingerprint of the client hello, or the zero value if it hasn't been read or is invalid.
+func (c *Conn) Fingerprint() Fingerprint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fp
+}
+
+// Listener wraps accepted connections in a Conn. It must be placed in front of the TLS server.
+type Listener struct {
+	net.Listener
+}
+
+func (l Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn}, nil
+}
+
+// FromConn returns the fingerprint of a connection accepted by a Listener, looking through TLS and other wrappers
+// that expose the underlying connection with a NetConn method.
+func FromConn(conn net.Conn) (Fingerprint, bool) {
+	for conn != nil {
+		if c, ok := conn.(*Conn); ok {
+			return c.Fingerprint(), true
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+	return Fingerprint{}, false
+}
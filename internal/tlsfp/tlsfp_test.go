@@ -0,0 +1,192 @@
+package tlsfp
+
+import (
+	"crypto/md5" // #nosec G501 -- JA3 is defined as an MD5 hash
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"regexp"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// buildClientHello builds a client hello record in the shape of the example of the JA4 specification.
+func buildClientHello(t *testing.T) []byte {
+	t.Helper()
+
+	ciphers := []uint16{0x3a3a, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035}
+	sigAlgs := []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601}
+	groups := []uint16{0x2a2a, 0x001d, 0x0017, 0x0018}
+
+	var b cryptobyte.Builder
+	b.AddUint8(handshakeTypeClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(0x0303)
+		b.AddBytes(make([]byte, 32))
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, cipher := range ciphers {
+				b.AddUint16(cipher)
+			}
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			ext := func(extType uint16, data func(b *cryptobyte.Builder)) {
+				b.AddUint16(extType)
+				b.AddUint16LengthPrefixed(data)
+			}
+			empty := func(b *cryptobyte.Builder) {}
+
+			ext(0x1a1a, empty)
+			ext(0x0023, empty)
+			ext(extServerName, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8(0)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("example.com")) })
+				})
+			})
+			ext(extSupportedGroups, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					for _, group := range groups {
+						b.AddUint16(group)
+					}
+				})
+			})
+			ext(0x0033, empty)
+			ext(extECPointFormats, func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+			})
+			ext(extSignatureAlgorithms, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					for _, alg := range sigAlgs {
+						b.AddUint16(alg)
+					}
+				})
+			})
+			ext(extALPN, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					for _, proto := range []string{"h2", "http/1.1"} {
+						b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(proto)) })
+					}
+				})
+			})
+			ext(extSupportedVersions, func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(0x4a4a)
+					b.AddUint16(0x0304)
+					b.AddUint16(0x0303)
+				})
+			})
+			for _, extType := range []uint16{0x0005, 0x0012, 0x0015, 0x0017, 0x001b, 0x002d, 0x4469, 0xff01} {
+				ext(extType, empty)
+			}
+		})
+	})
+
+	msg := b.BytesOrPanic()
+	record := append([]byte{recordTypeHandshake, 0x03, 0x01, byte(len(msg) >> 8), byte(len(msg))}, msg...)
+	return record
+}
+
+func TestFingerprint(t *testing.T) {
+	record := buildClientHello(t)
+
+	hello, err := ParseClientHello(record[recordHeaderLen:])
+	if err != nil {
+		t.Fatalf("failed to parse client hello: %v", err)
+	}
+
+	// The hash parts are the ones of the example in the JA4 specification.
+	if got, expected := hello.JA4(), "t13d1516h2_8daaf6152771_e5627efa2ab1"; got != expected {
+		t.Errorf("expected JA4 %s, got %s", expected, got)
+	}
+
+	expectedJA3 := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"35-0-10-51-11-13-16-43-5-18-21-23-27-45-17513-65281,29-23-24,0"
+	if got := hello.JA3(); got != expectedJA3 {
+		t.Errorf("expected JA3 string %s, got %s", expectedJA3, got)
+	}
+	sum := md5.Sum([]byte(expectedJA3)) // #nosec G401 -- JA3 is defined as an MD5 hash
+	if got := hello.Fingerprint().JA3; got != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected JA3 hash of the JA3 string, got %s", got)
+	}
+}
+
+func TestConnFragmented(t *testing.T) {
+	record := buildClientHello(t)
+
+	// Split the hello into two records, and read it a few bytes at a time.
+	msg := record[recordHeaderLen:]
+	split := len(msg) / 2
+	var stream []byte
+	for _, fragment := range [][]byte{msg[:split], msg[split:]} {
+		stream = append(stream, recordTypeHandshake, 0x03, 0x01, byte(len(fragment)>>8), byte(len(fragment)))
+		stream = append(stream, fragment...)
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		_, _ = client.Write(stream)
+		_ = client.Close()
+	}()
+
+	conn := &Conn{Conn: server}
+	buf := make([]byte, 7)
+	for {
+		if _, err := conn.Read(buf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+	}
+
+	if got := conn.Fingerprint().JA4; got != "t13d1516h2_8daaf6152771_e5627efa2ab1" {
+		t.Errorf("expected fragmented hello to be fingerprinted, got %q", got)
+	}
+}
+
+func TestListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+			ServerName:         "example.com",
+			NextProtos:         []string{"http/1.1"},
+			InsecureSkipVerify: true, // #nosec G402 -- the handshake is never completed
+		})
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	conn, err := Listener{ln}.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer conn.Close()
+
+	// The server side of the handshake fails without a certificate, after reading the client hello.
+	tlsConn := tls.Server(conn, &tls.Config{MinVersion: tls.VersionTLS12})
+	_ = tlsConn.Handshake()
+
+	fp, ok := FromConn(tlsConn)
+	if !ok {
+		t.Fatal("expected the fingerprinted connection to be found through the TLS connection")
+	}
+	if !regexp.MustCompile(`^t13d\d{4}h1_[0-9a-f]{12}_[0-9a-f]{12}$`).MatchString(fp.JA4) {
+		t.Errorf("unexpected JA4 %q", fp.JA4)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(fp.JA3) {
+		t.Errorf("unexpected JA3 %q", fp.JA3)
+	}
+
+	if _, ok := FromConn(&net.TCPConn{}); ok {
+		t.Error("expected no fingerprint for a plain connection")
+	}
+}
@@ -12,14 +12,25 @@ mod solver;
 #[cold]
 fn unlikely() {}
 
-/// Compute a mask for a Cerberus PoW (mask & V[0] == 0)
-pub const fn compute_mask_cerberus(difficulty_factor: core::num::NonZeroU8) -> u32 {
-    if difficulty_factor.get() == 16 {
+/// Maximum supported difficulty in leading zero bits.
+pub const MAX_DIFFICULTY_BITS: u32 = 64;
+
+/// Compute the masks for a Cerberus PoW (mask[0] & V[0] == 0 && mask[1] & V[1] == 0)
+pub const fn compute_mask_cerberus(difficulty_bits: u32) -> [u32; 2] {
+    [
+        compute_word_mask(difficulty_bits),
+        compute_word_mask(difficulty_bits.saturating_sub(32)),
+    ]
+}
+
+/// Compute the mask covering the given number of leading bits of a hash word
+const fn compute_word_mask(bits: u32) -> u32 {
+    if bits >= 32 {
         return !0;
     }
     // Cerberus compares output as if it was big endian, but BLAKE3 outputs little endian
     // so a byte swap is needed for the correct significance order
-    !(!0u32 >> (difficulty_factor.get() * 2)).swap_bytes()
+    !(!0u32 >> bits).swap_bytes()
 }
 
 #[cfg(all(target_arch = "wasm32", target_feature = "simd128"))]
@@ -109,8 +120,11 @@ impl CerberusMessage {
 pub fn process_task(data: &str, difficulty: u32, thread_id: u32, threads: u32) {
     let worker = worker_global_scope();
 
-    let mask =
-        compute_mask_cerberus(core::num::NonZeroU8::new(difficulty.try_into().unwrap()).unwrap());
+    assert!(
+        difficulty > 0 && difficulty <= MAX_DIFFICULTY_BITS,
+        "difficulty out of range"
+    );
+    let mask = compute_mask_cerberus(difficulty);
 
     let mut set = thread_id;
 
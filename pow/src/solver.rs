@@ -11,6 +11,8 @@ pub trait Solver {
 
     /// Returns a valid nonce and its corresponding hash value.
     ///
+    /// The masks apply to the first two words of the hash, see [`crate::compute_mask_cerberus`].
+    ///
     /// Returns None when the solver cannot solve the prefix.
     ///
     /// Progress report callback is periodically called with the number of _additional_ attempts made
@@ -18,33 +20,37 @@ pub trait Solver {
     ///
     /// Failure is usually because the key space is exhausted (or presumed exhausted).
     /// It should by design happen extremely rarely for common difficulty settings.
-    fn solve<P: FnMut(u32)>(&mut self, mask: u32, progress: P) -> Option<([u32; 2], [u32; 8])>;
+    fn solve<P: FnMut(u32)>(&mut self, mask: [u32; 2], progress: P) -> Option<([u32; 2], [u32; 8])>;
 }
 
 #[cfg(test)]
 pub(crate) mod tests {
     use super::*;
 
-    #[allow(unused)]
-    mod legacy_check_dubit {
-        pub fn check_leading_zero_dubits(n: usize) -> fn(&[u8; 32], usize) -> bool {
-            match n {
-                0..=16 => check_small,
-                _ => check_general,
+    fn check_leading_zero_bits(hash: &[u8; 32], n: u32) -> bool {
+        let mut remaining = n;
+        for b in hash {
+            if remaining == 0 {
+                return true;
             }
+            if remaining < 8 {
+                return b.leading_zeros() >= remaining;
+            }
+            if *b != 0 {
+                return false;
+            }
+            remaining -= 8;
         }
+        remaining == 0
+    }
 
-        fn check_small(hash: &[u8; 32], n: usize) -> bool {
-            let first_word: u32 = (hash[0] as u32) << 24
-                | (hash[1] as u32) << 16
-                | (hash[2] as u32) << 8
-                | (hash[3] as u32);
-            first_word.leading_zeros() >= (n as u32 * 2)
-        }
-
-        fn check_general(hash: &[u8; 32], n: usize) -> bool {
-            panic!("I'm lazy")
-        }
+    #[test]
+    fn test_compute_mask() {
+        assert_eq!(crate::compute_mask_cerberus(1), [0x80, 0]);
+        assert_eq!(crate::compute_mask_cerberus(12), [0xf0ff, 0]);
+        assert_eq!(crate::compute_mask_cerberus(32), [!0, 0]);
+        assert_eq!(crate::compute_mask_cerberus(33), [!0, 0x80]);
+        assert_eq!(crate::compute_mask_cerberus(64), [!0, !0]);
     }
 
     pub(crate) fn test_cerberus_validator<
@@ -53,8 +59,8 @@ pub(crate) mod tests {
     >(
         mut factory: F,
     ) {
-        for df in 6..=8 {
-            let mask = crate::compute_mask_cerberus(df.try_into().unwrap());
+        for bits in 12..=16 {
+            let mask = crate::compute_mask_cerberus(bits);
 
             let test_seed: [u8; 64] = core::array::from_fn(|i| b'a'.wrapping_add(i as u8));
 
@@ -77,13 +83,10 @@ pub(crate) mod tests {
                     ref_hash_bytes[i * 4 + 3],
                 ])
             });
-            let hit = (ref_hash[0] & mask) == 0;
+            let hit = (ref_hash[0] & mask[0]) == 0 && (ref_hash[1] & mask[1]) == 0;
             assert_eq!(hash, ref_hash, "incorrect output: {:?}", nonce);
             assert!(hit);
-            assert!(legacy_check_dubit::check_leading_zero_dubits(df as usize)(
-                &ref_hash_bytes,
-                df as usize
-            ));
+            assert!(check_leading_zero_bits(ref_hash_bytes, bits));
         }
     }
 }
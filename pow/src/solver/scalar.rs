@@ -26,7 +26,7 @@ impl crate::solver::Solver for CerberusSolver {
         self.report_slot = tid * Self::REPORT_PERIOD / threads;
     }
 
-    fn solve<P: FnMut(u32)>(&mut self, mask: u32, mut progress: P) -> Option<([u32; 2], [u32; 8])> {
+    fn solve<P: FnMut(u32)>(&mut self, mask: [u32; 2], mut progress: P) -> Option<([u32; 2], [u32; 8])> {
         let mut msg = [0; 16];
         msg[0] = self.message.batch_id;
         for nonce in 0..u32::MAX {
@@ -43,7 +43,7 @@ impl crate::solver::Solver for CerberusSolver {
             if self.attempted_nonces % Self::REPORT_PERIOD == self.report_slot {
                 progress(Self::REPORT_PERIOD);
             }
-            if hash[0] & mask as u32 == 0 {
+            if hash[0] & mask[0] == 0 && hash[1] & mask[1] == 0 {
                 crate::unlikely();
 
                 return Some(([self.message.batch_id, nonce], hash));
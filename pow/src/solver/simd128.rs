@@ -26,7 +26,7 @@ impl crate::solver::Solver for CerberusSolver {
     }
 
     #[inline(never)]
-    fn solve<P: FnMut(u32)>(&mut self, mask: u32, mut progress: P) -> Option<([u32; 2], [u32; 8])> {
+    fn solve<P: FnMut(u32)>(&mut self, mask: [u32; 2], mut progress: P) -> Option<([u32; 2], [u32; 8])> {
         let mut msg = [0; 16];
         msg[0] = self.message.batch_id;
 
@@ -40,11 +40,13 @@ impl crate::solver::Solver for CerberusSolver {
 
         let mut nonce = u32x4(0, 1, 2, 3);
         let four = u32x4_splat(4);
-        let maskv = u32x4_splat(mask);
+        let maskv0 = u32x4_splat(mask[0]);
+        let maskv1 = u32x4_splat(mask[1]);
         for rep in 0..(u32::MAX / 4) {
             let mut state = midstate;
             crate::blake3::simd128::compress_mb4::<1>(&mut state, &msg, nonce);
-            let masked = v128_and(state[0], maskv);
+            // A lane is a hit only if both masked words are zero
+            let masked = v128_or(v128_and(state[0], maskv0), v128_and(state[1], maskv1));
             nonce = u32x4_add(nonce, four);
 
             if !u32x4_all_true(masked) {
@@ -52,7 +54,7 @@ impl crate::solver::Solver for CerberusSolver {
 
                 let mut extract = [0u32; 4];
                 unsafe { v128_store(extract.as_mut_ptr().cast(), masked) };
-                let success_lane_idx = extract.iter().position(|x| *x & mask == 0).unwrap();
+                let success_lane_idx = extract.iter().position(|x| *x == 0).unwrap();
                 msg[1] = rep * 4 + success_lane_idx as u32;
 
                 let hash = crate::blake3::compress8(
@@ -0,0 +1,7 @@
+// Package translations embeds the translations of the pages and scripts served by cerberus.
+package translations
+
+import "embed"
+
+//go:embed *.yaml
+var FS embed.FS
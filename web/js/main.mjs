@@ -27,6 +27,7 @@ const dom = {
   message: document.getElementById('message'),
   description: document.getElementById('description'),
   code: document.getElementById('code'),
+  captchaOffer: document.getElementById('captcha-offer'),
 }
 
 const ui = {
@@ -57,30 +58,105 @@ const ui = {
     dom.code.classList.toggle('hidden!', !code);
     dom.code.textContent = code;
   },
+  captchaOffer: () => dom.captchaOffer?.classList.remove('hidden'),
 }
 
-function createAnswerForm(hash, solution, baseURL, nonce, ts, signature) {
-  function addHiddenInput(form, name, value) {
-    const input = document.createElement('input');
-    input.type = 'hidden';
-    input.name = name;
-    input.value = value;
-    form.appendChild(input);
+// The number of challenges to solve before giving up. Failed attempts count towards the pending limit.
+const maxAttempts = 2;
+
+// Fetches a fresh challenge in exchange for the previous one, or the failure result.
+async function fetchChallenge(baseURL, { nonce, ts, signature, difficulty }) {
+  const params = new URLSearchParams({ nonce, ts, signature, difficulty });
+  const response = await fetch(`${baseURL}/challenge?${params}`, {
+    headers: { 'Accept': 'application/json' },
+    credentials: 'same-origin',
+  });
+
+  if (!response.headers.get('Content-Type')?.startsWith('application/json')) {
+    throw new Error(`unexpected response: ${response.status} ${response.statusText}`);
+  }
+  return await response.json();
+}
+
+// The server only redirects to paths on the same origin.
+const currentPath = () => window.location.pathname + window.location.search + window.location.hash;
+
+async function submitAnswer(hashes, solutions, baseURL, { nonce, ts, signature, difficulty }, redir, replay, telemetry) {
+  const response = await fetch(`${baseURL}/answer`, {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+      'Accept': 'application/json',
+    },
+    credentials: 'same-origin',
+    body: JSON.stringify({
+      response: hashes,
+      solution: solutions,
+      nonce,
+      ts,
+      signature,
+      difficulty,
+      redir,
+      replay,
+      ...telemetry,
+    }),
+  });
+
+  if (!response.headers.get('Content-Type')?.startsWith('application/json')) {
+    throw new Error(`unexpected response: ${response.status} ${response.statusText}`);
+  }
+  return await response.json();
+}
+
+// Re-submits the request that was interrupted by the challenge.
+async function resubmit({ method, url, contentType, body }) {
+  const bytes = Uint8Array.from(atob(body ?? ''), (c) => c.charCodeAt(0));
+
+  // Plain forms are re-submitted as a form, so that the browser navigates as usual.
+  if (method === 'POST' && contentType?.startsWith('application/x-www-form-urlencoded')) {
+    const form = document.createElement('form');
+    form.method = 'POST';
+    form.action = url;
+    for (const [name, value] of new URLSearchParams(new TextDecoder().decode(bytes))) {
+      const input = document.createElement('input');
+      input.type = 'hidden';
+      input.name = name;
+      input.value = value;
+      form.appendChild(input);
+    }
+    document.body.appendChild(form);
+    form.submit();
+    return;
   }
 
-  const form = document.createElement('form');
-  form.method = 'POST';
-  form.action = `${baseURL}/answer`;
+  // Anything else can't be expressed as a form, so send it as is and show the response in place.
+  const response = await fetch(url, {
+    method,
+    headers: contentType ? { 'Content-Type': contentType } : {},
+    body: bytes.length > 0 ? bytes : undefined,
+    credentials: 'same-origin',
+  });
+  const text = await response.text();
+  window.history.replaceState(null, '', response.url);
+  document.open();
+  document.write(text);
+  document.close();
+}
 
-  addHiddenInput(form, 'response', hash);
-  addHiddenInput(form, 'solution', solution);
-  addHiddenInput(form, 'nonce', nonce);
-  addHiddenInput(form, 'ts', ts);
-  addHiddenInput(form, 'signature', signature);
-  addHiddenInput(form, 'redir', window.location.href);
+const handleRejection = ({ outcome, reason }) => {
+  ui.areaMode('message');
+  ui.mascotState('fail');
 
-  document.body.appendChild(form);
-  return form;
+  if (outcome === 'blocked') {
+    ui.title(t('error.access_restricted'));
+    ui.message(t('error.ip_blocked'));
+    ui.description(t('error.wait_before_retry'));
+  } else {
+    ui.title(t('error.error_occurred'));
+    ui.message(t('error.server_error'));
+    ui.description(t('error.browser_config_or_bug'));
+    ui.code(t('error.error_details', { error: reason }));
+  }
 }
 
 const handleError = (error) => {
@@ -91,6 +167,7 @@ const handleError = (error) => {
   if (error.message && error.message.includes("Failed to initialize WebAssembly module")) {
     ui.message(t('error.must_enable_wasm'));
     ui.description(t('error.apologize_please_enable_wasm'));
+    ui.captchaOffer();
     console.error(error);
   } else {
     ui.message(t('error.client_error'));
@@ -99,69 +176,122 @@ const handleError = (error) => {
   }
 }
 
-const main = async () => {
-  const thisScript = document.getElementById('challenge-script');
-  const { challenge, difficulty, nonce: inputNonce, ts, signature } = JSON.parse(thisScript.getAttribute('x-challenge'));
-  const { baseURL, locale } = JSON.parse(thisScript.getAttribute('x-meta'));
-
-  // Set locale
-  messages.locale = locale;
+// Solves all sub-puzzles of a challenge while reporting progress.
+const solve = async ({ challenge, difficulty, puzzles, nonce: inputNonce, ts, signature }) => {
+  // difficulty is the number of leading zero bits required in the hash of each sub-puzzle,
+  // while the displayed difficulty is the total across all sub-puzzles.
+  const totalDifficulty = difficulty + Math.log2(puzzles);
 
   // Set initial checking state
-  ui.init();
   ui.areaMode('progress');
   ui.title(t('challenge.title'));
   ui.mascotState('puzzle');
   ui.status(t('challenge.calculating'));
-  ui.metrics(t('challenge.difficulty_speed', { difficulty, speed: 0 }));
+  ui.metrics(t('challenge.difficulty_speed', { difficulty: totalDifficulty, speed: 0 }));
   ui.progressMessage('');
   ui.progress(0);
 
   const t0 = Date.now();
   let lastUpdate = 0;
 
-  const likelihood = Math.pow(16, -difficulty / 2);
+  const likelihood = Math.pow(2, -difficulty);
+  // Same as a 1% chance of still being unsolved for a single puzzle.
+  const slowIters = Math.log(100) * puzzles / likelihood;
 
   let totalIters = 0;
+  const hashes = [];
+  const solutions = [];
 
-  const mergedChallenge = `${challenge}|${inputNonce}|${ts}|${signature}|`;
-  const { hash, nonce: solution } = await pow(mergedChallenge, difficulty, null, (iters) => {
-    // the probability of still being on the page is (1 - likelihood) ^ iters.
-    // by definition, half of the time the progress bar only gets to half, so
-    // apply a polynomial ease-out function to move faster in the beginning
-    // and then slow down as things get increasingly unlikely. quadratic felt
-    // the best in testing, but this may need adjustment in the future.
-    totalIters += iters;
-    const probability = Math.pow(1 - likelihood, totalIters);
-    const distance = (1 - Math.pow(probability, 2)) * 100;
-
-    // Update progress every 200ms
-    const now = Date.now();
-    const delta = now - t0;
-
-    if (delta - lastUpdate > 200) {
-      const speed = totalIters / delta;
-      ui.progress(distance);
-      ui.metrics(t('challenge.difficulty_speed', { difficulty, speed: speed.toFixed(3) }));
-      ui.progressMessage(probability < 0.01 ? t('challenge.taking_longer') : undefined);
-      lastUpdate = delta;
-    };
-  });
+  for (let i = 0; i < puzzles; i++) {
+    let puzzleIters = 0;
+
+    const mergedChallenge = `${challenge}|${inputNonce}|${ts}|${signature}|${i}|`;
+    const { hash, nonce: solution } = await pow(mergedChallenge, difficulty, null, (iters) => {
+      // the probability of still being on this sub-puzzle is (1 - likelihood) ^ iters.
+      // by definition, half of the time the progress bar only gets to half, so
+      // apply a polynomial ease-out function to move faster in the beginning
+      // and then slow down as things get increasingly unlikely. quadratic felt
+      // the best in testing, but this may need adjustment in the future.
+      // solved sub-puzzles count as certain progress.
+      totalIters += iters;
+      puzzleIters += iters;
+      const probability = Math.pow(1 - likelihood, puzzleIters);
+      const distance = (i + 1 - Math.pow(probability, 2)) / puzzles * 100;
+
+      // Update progress every 200ms
+      const now = Date.now();
+      const delta = now - t0;
+
+      if (delta - lastUpdate > 200) {
+        const speed = totalIters / delta;
+        ui.progress(distance);
+        ui.metrics(t('challenge.difficulty_speed', { difficulty: totalDifficulty, speed: speed.toFixed(3) }));
+        ui.progressMessage(totalIters > slowIters ? t('challenge.taking_longer') : undefined);
+        lastUpdate = delta;
+      };
+    });
+
+    hashes.push(hash);
+    solutions.push(solution);
+  }
   const t1 = Date.now();
 
   // Show success state
   ui.title(t('success.title'));
   ui.mascotState('pass');
   ui.status(t('success.verification_complete'));
-  ui.metrics(t('success.took_time_iterations', { time: t1 - t0, iterations: solution }));
+  ui.metrics(t('success.took_time_iterations', { time: t1 - t0, iterations: totalIters }));
   ui.progressMessage('');
   ui.progress(0);
 
-  const form = createAnswerForm(hash, solution, baseURL, inputNonce, ts, signature);
-  setTimeout(() => {
-    form.submit();
-  }, 250);
+  // Solve statistics help the server tell real browsers from native solvers.
+  const telemetry = {
+    elapsed: t1 - t0,
+    iterations: totalIters,
+    hashrate: t1 > t0 ? Math.round(totalIters / (t1 - t0) * 1000) : 0,
+  };
+
+  return { hashes, solutions, telemetry };
+}
+
+const main = async () => {
+  const thisScript = document.getElementById('challenge-script');
+  let input = JSON.parse(thisScript.getAttribute('x-challenge'));
+  const { baseURL, locale, redir, replay } = JSON.parse(thisScript.getAttribute('x-meta'));
+
+  // Set locale
+  messages.locale = locale;
+
+  ui.init();
+
+  for (let attempt = 1; ; attempt++) {
+    const { hashes, solutions, telemetry } = await solve(input);
 
+    await new Promise((resolve) => setTimeout(resolve, 250));
+
+    const result = await submitAnswer(hashes, solutions, baseURL, input, redir ?? currentPath(), replay, telemetry);
+    if (result.outcome === 'pass') {
+      if (result.replay) {
+        await resubmit(result.replay);
+      } else {
+        window.location.replace(result.redirect);
+      }
+      return;
+    }
+    if (result.outcome === 'blocked' || attempt >= maxAttempts) {
+      handleRejection(result);
+      return;
+    }
+
+    // Retry in place with a fresh challenge instead of reloading the page.
+    console.warn(`attempt ${attempt} failed: ${result.reason}`);
+    const challenge = await fetchChallenge(baseURL, input);
+    if (challenge.outcome) {
+      handleRejection(challenge);
+      return;
+    }
+    input = challenge;
+  }
 };
 
-main().catch(handleError);
\ No newline at end of file
+main().catch(handleError);
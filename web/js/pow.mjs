@@ -17,7 +17,7 @@ const supportsSimd = () => {
 
 export default async function process(
   data,
-  difficulty = 5,
+  difficulty = 10,
   signal = null,
   progressCallback = null,
   threads = (navigator.hardwareConcurrency || 1),
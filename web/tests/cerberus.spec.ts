@@ -8,7 +8,11 @@ test.beforeEach(async ({ page }, { tags }) => {
     await page.goto('/nojs/foo.iso');
   } else if (tags.includes('@nowasm')) {
     await page.goto('/nowasm/foo.iso');
-  } else if (tags.includes('@nocerberus')) {
+  } else if (tags.includes('@forwardauth')) {
+    await page.goto('/forward/foo');
+  } else if (tags.includes('@widget')) {
+    await page.goto('/widget.html');
+  } else if (tags.includes('@nocerberus') || tags.includes('@replay')) {
     await page.goto('/foo');
   } else {
     await page.goto('/foo.iso');
@@ -19,12 +23,23 @@ test.describe('javascript disabled', { tag: '@nojs' }, () => {
   test('must show a javascript disabled message', async ({ page }) => {
     await expect(page.getByText('You must enable JavaScript to proceed.')).toBeVisible();
   });
+
+  test('must continue after waiting', async ({ page }) => {
+    await expect(page.getByText('Alternatively, you can wait 2 seconds')).toBeVisible();
+    await expect(page.getByText('Hello, foo.iso!')).toBeVisible({ timeout: 10000 });
+  });
 });
 
 test.describe('webassembly disabled', { tag: '@nowasm' }, () => {
   test('must show a webassembly disabled message', async ({ page }) => {
     await expect(page.getByText('Please enable WebAssembly to proceed.')).toBeVisible();
   });
+
+  test('must offer an image challenge', async ({ page }) => {
+    await page.getByText('Alternatively, you can solve an image challenge instead.').click();
+    await expect(page.getByText('Type the characters you see')).toBeVisible();
+    await expect(page.locator('#captcha-image')).toBeVisible();
+  });
 });
 
 test.describe('cerberus disabled', { tag: '@nocerberus' }, () => {
@@ -33,6 +48,68 @@ test.describe('cerberus disabled', { tag: '@nocerberus' }, () => {
   });
 });
 
+test.describe('form protection widget', { tag: '@widget' }, () => {
+  test('must issue a single-use token', async ({ page }) => {
+    await expect(page.getByText('Verified')).toBeVisible({ timeout: 30000 });
+    const token = await page.locator('input[name="cerberus-token"]').inputValue();
+
+    const first = await page.request.post('/.cerberus/siteverify', { form: { token, secret: 'test-secret' } });
+    expect(await first.json()).toMatchObject({ success: true });
+
+    const second = await page.request.post('/.cerberus/siteverify', { form: { token, secret: 'test-secret' } });
+    expect(await second.json()).toEqual({ success: false, 'error-codes': ['timeout-or-duplicate'] });
+  });
+
+  test('must reject invalid tokens', async ({ page }) => {
+    const res = await page.request.post('/.cerberus/siteverify', { form: { token: 'invalid', secret: 'test-secret' } });
+    expect(await res.json()).toEqual({ success: false, 'error-codes': ['invalid-input-response'] });
+  });
+
+  test('must require the secret', async ({ page }) => {
+    const res = await page.request.post('/.cerberus/siteverify', { form: { token: 'invalid' } });
+    expect(await res.json()).toEqual({ success: false, 'error-codes': ['missing-input-secret'] });
+  });
+});
+
+test.describe('forward auth', { tag: '@forwardauth' }, () => {
+  test('must send unauthorized requests to the challenge page', async ({ page }) => {
+    const res = await page.request.get('/forward/foo', { maxRedirects: 0 });
+    expect(res.status()).toBe(401);
+    expect(res.headers()['location']).toBe('/.cerberus/challenge-page?redir=%2Fforward%2Ffoo');
+  });
+
+  test('must pass after solving the challenge', async ({ page }) => {
+    await expect(page.getByText('Hello, foo!')).toBeVisible({ timeout: 30000 });
+    expect(new URL(page.url()).pathname).toBe('/forward/foo');
+  });
+});
+
+test.describe('request replay', { tag: '@replay' }, () => {
+  test('must re-submit a form after passing', async ({ page }) => {
+    const posts: (string | null)[] = [];
+    page.on('request', (req) => {
+      if (req.method() === 'POST' && req.url().endsWith('/foo.iso')) {
+        posts.push(req.postData());
+      }
+    });
+
+    await page.evaluate(() => {
+      const form = document.createElement('form');
+      form.method = 'POST';
+      form.action = '/foo.iso';
+      const input = document.createElement('input');
+      input.name = 'text';
+      input.value = 'hello world';
+      form.appendChild(input);
+      document.body.appendChild(form);
+      form.submit();
+    });
+
+    await expect(page.getByText('Hello, foo.iso!')).toBeVisible({ timeout: 30000 });
+    expect(posts).toEqual(['text=hello+world', 'text=hello+world']);
+  });
+});
+
 test.describe(() => {
   // NOTE This test runs slowly in Firefox due to Playwright's devtools integration causing WebAssembly performance degradation
   // NOTE See: https://github.com/microsoft/playwright/issues/11102
@@ -45,15 +122,49 @@ test.describe(() => {
 
   test("must fail when response is incorrect", async ({page}) => {
     page.route("/.cerberus/answer", async (route, req) => {
-      const formData = await req.postDataJSON() as { response: string, solution: string, nonce: string, ts: string, signature: string };
-      formData.response = "1145141919810";
-      await route.continue({
-        postData: Object.entries(formData)
-          .map(([key, value]) => `${encodeURIComponent(key)}=${encodeURIComponent(value)}`)
-          .join('&')
-      });
+      const body = await req.postDataJSON() as { response: string[], solution: number[], nonce: string, ts: number, signature: string };
+      body.response = body.response.map(() => "1145141919810");
+      await route.continue({ postData: JSON.stringify(body) });
     });
 
-    await expect(page.getByText('Server returned an error that we cannot handle.')).toBeVisible({ timeout: 30000 });
+    // The page retries once with a fresh challenge before giving up.
+    await expect(page.getByText('Server returned an error that we cannot handle.')).toBeVisible({ timeout: 60000 });
+  })
+
+  test("must not be indexed", async ({ page }) => {
+    const res = await page.request.get("/foo.iso");
+    expect(res.headers()["x-robots-tag"]).toBe("noindex");
+    await expect(page.locator('meta[name="robots"]')).toHaveAttribute("content", "noindex");
+  })
+
+  test("must answer HEAD without a body", async ({ page }) => {
+    const res = await page.request.head("/foo.iso");
+    expect(res.headers()["x-cerberus-status"]).toBe("CHALLENGE");
+    expect(await res.body()).toHaveLength(0);
+  })
+
+  test("must let CORS preflight requests through", async ({ page }) => {
+    const res = await page.request.fetch("/foo.iso", {
+      method: "OPTIONS",
+      headers: { Origin: "https://example.com", "Access-Control-Request-Method": "POST" },
+    });
+    expect(res.headers()["x-cerberus-status"]).toBe("PREFLIGHT");
+  })
+
+  test("must respond compactly to non-navigation requests", async ({ page }) => {
+    const res = await page.request.get("/foo.iso", {
+      headers: { Accept: "application/json", "Sec-Fetch-Mode": "cors", "Sec-Fetch-Dest": "empty" },
+    });
+    expect(res.status()).toBe(403);
+    expect(res.headers()["x-cerberus-challenge"]).toBe("/.cerberus/challenge");
+    expect(await res.json()).toEqual({ outcome: "challenge", challenge: "/.cerberus/challenge" });
+  })
+
+  test("must issue a fresh challenge", async ({ page }) => {
+    const res = await page.request.get("/.cerberus/challenge", { headers: { Accept: "application/json" } });
+    expect(res.ok()).toBeTruthy();
+    const challenge = await res.json();
+    expect(challenge).toHaveProperty("challenge");
+    expect(challenge).toHaveProperty("signature");
   })
 });
\ No newline at end of file
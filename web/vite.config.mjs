@@ -18,6 +18,7 @@ export default defineConfig({
         rollupOptions: {
             input: [
                 "./js/main.mjs",
+                "./js/widget.mjs",
                 "./js/assets.mjs",
                 "./global.css",
             ]